@@ -0,0 +1,136 @@
+package httpsession
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec encodes session values for the store. Encode and Decode are called
+// with the same values in the same order, and a new Codec is created for
+// every session.
+type Codec interface {
+	NewEncoder(w io.Writer)
+	Encode(v interface{}) error
+	// FinishEncode is called after the last value is encoded.
+	FinishEncode() error
+	NewDecoder(r io.Reader)
+	Decode(v interface{}) error
+}
+
+// CodecID is written as the first byte of every stored session, so that a
+// session can be read with the codec that wrote it.
+type CodecID byte
+
+const (
+	GobCodec CodecID = iota + 1
+	JSONCodec
+	// JSONObjectCodec stores the values as one JSON object. It is the
+	// default.
+	JSONObjectCodec
+)
+
+// legacyHeader starts sessions written before codec ids were stored, which
+// all use JSONObjectCodec.
+const legacyHeader = '{'
+
+// reservedCodecID reports whether id can't be registered. 0xc0 to 0xc2 are
+// the headers compressstore puts in front of entry data, which it tells
+// apart from a session by its first byte.
+func reservedCodecID(id CodecID) bool {
+	return id == 0 || id == legacyHeader || (id >= 0xc0 && id <= 0xc2)
+}
+
+var codecs = struct {
+	m map[CodecID]func() Codec
+	sync.RWMutex
+}{m: map[CodecID]func() Codec{
+	GobCodec:        func() Codec { return &sessionGob{} },
+	JSONCodec:       func() Codec { return &sessionJSON{} },
+	JSONObjectCodec: func() Codec { return &sessionJSONObject{} },
+}}
+
+// RegisterCodec makes a custom codec available under id. Like gob.Register
+// it is meant to be called from init, and panics if id is in use or
+// reserved. 0, '{' and 0xc0 to 0xc2 are reserved.
+func RegisterCodec(id CodecID, newCodec func() Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	if _, ok := codecs.m[id]; ok || reservedCodecID(id) {
+		panic(fmt.Sprintf("httpsession: codec id %d already in use", id))
+	}
+	codecs.m[id] = newCodec
+}
+
+func newCodec(id CodecID) (Codec, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	if f, ok := codecs.m[id]; ok {
+		return f(), nil
+	}
+	return nil, fmt.Errorf("unknown session codec id %d", id)
+}
+
+// sessionCodecSelect writes with one codec and reads with the codec named in
+// the header of the stored session.
+type sessionCodecSelect struct {
+	id      CodecID
+	encoder Codec
+	decoder Codec
+	err     error
+}
+
+func newSessionCodecSelect(id CodecID) (*sessionCodecSelect, error) {
+	if id == 0 {
+		id = JSONObjectCodec
+	}
+	c, err := newCodec(id)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionCodecSelect{id: id, encoder: c}, nil
+}
+
+func (s *sessionCodecSelect) NewEncoder(w io.Writer) {
+	w.Write([]byte{byte(s.id)})
+	s.encoder.NewEncoder(w)
+}
+
+func (s *sessionCodecSelect) Encode(v interface{}) error {
+	return s.encoder.Encode(v)
+}
+
+func (s *sessionCodecSelect) FinishEncode() error {
+	return s.encoder.FinishEncode()
+}
+
+func (s *sessionCodecSelect) NewDecoder(r io.Reader) {
+	br := bufio.NewReader(r)
+	s.decoder, s.err = nil, nil
+
+	header, err := br.Peek(1)
+	if err != nil {
+		s.err = err
+		return
+	}
+	id := CodecID(header[0])
+	if id == legacyHeader {
+		id = JSONObjectCodec
+	} else {
+		br.ReadByte()
+	}
+	if id == s.id {
+		s.decoder = s.encoder
+	} else if s.decoder, s.err = newCodec(id); s.err != nil {
+		return
+	}
+	s.decoder.NewDecoder(br)
+}
+
+func (s *sessionCodecSelect) Decode(v interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.decoder.Decode(v)
+}
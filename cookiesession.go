@@ -1,21 +1,15 @@
 package httpsession
 
 import (
+	"context"
 	"github.com/timob/httpsession/store"
-	"github.com/timob/httpsession/token"
 	"github.com/timob/httpsession/token/sessioncookie"
 	"net/http"
 	"time"
 )
 
 type CookieSession struct {
-	store        store.SessionEntryStore
-	name         string
-	sessionToken token.Token
-	cookie       *sessioncookie.SessionCookie
-	authCookie   *sessioncookie.SessionCookie
-	authToken    token.Token
-	*AuthSession
+	*TransportSession
 }
 
 type AuthTimeout time.Duration
@@ -26,37 +20,40 @@ func OpenCookieSession(name string, store store.SessionEntryStore, w http.Respon
 	return DeaultAuthTimeout.OpenCookieSession(name, store, w, r)
 }
 
+// OpenCookieSessionContext is like OpenCookieSession, with store calls
+// cancelled as for OpenSessionContext. Pass r.Context() to stop store calls
+// when the client goes away.
+func OpenCookieSessionContext(ctx context.Context, name string, store store.SessionEntryStore, w http.ResponseWriter, r *http.Request) (*CookieSession, error) {
+	return DeaultAuthTimeout.OpenCookieSessionContext(ctx, name, store, w, r)
+}
+
 func (a AuthTimeout) OpenCookieSession(name string, store store.SessionEntryStore, w http.ResponseWriter, r *http.Request) (*CookieSession, error) {
-	c := new(CookieSession)
-	c.name = name
-	c.store = store
-	c.cookie = &sessioncookie.SessionCookie{name + "_session", w, r}
-	c.authCookie = &sessioncookie.SessionCookie{name + "_auth", w, r}
-	s, t, at, err := OpenSessionWithAuth(c.cookie.GetToken(), c.authCookie.GetToken(), time.Duration(a), store)
-	if err != nil {
-		return nil, err
-	}
-	c.AuthSession = s
-	c.sessionToken = t
-	c.authToken = at
-	return c, nil
+	return a.OpenCookieSessionContext(context.Background(), name, store, w, r)
 }
 
-func (c *CookieSession) Save(timeout time.Duration) {
-	c.Session.Save(timeout)
-	if c.InGracePeriod() == false {
-		c.cookie.SetToken(c.sessionToken, timeout)
-		c.authCookie.SetToken(c.authToken, timeout)
-	}
+func (a AuthTimeout) OpenCookieSessionContext(ctx context.Context, name string, store store.SessionEntryStore, w http.ResponseWriter, r *http.Request) (*CookieSession, error) {
+	return a.OpenCookieSessionWithOptions(ctx, name, store, w, r, sessioncookie.DefaultCookieOptions, Options{})
 }
 
-func (c *CookieSession) New() {
-	c.Session.Save(0)
-	c.Session.Clear()
-	c.sessionToken = c.Session.Recreate()
+// OpenCookieSessionWithOptions sets the session cookies with the attributes
+// in cookieOpts, which must pass sessioncookie.CookieOptions.Validate.
+func OpenCookieSessionWithOptions(ctx context.Context, name string, store store.SessionEntryStore, w http.ResponseWriter, r *http.Request, cookieOpts sessioncookie.CookieOptions, opts Options) (*CookieSession, error) {
+	return DeaultAuthTimeout.OpenCookieSessionWithOptions(ctx, name, store, w, r, cookieOpts, opts)
+}
+
+func (a AuthTimeout) OpenCookieSessionWithOptions(ctx context.Context, name string, store store.SessionEntryStore, w http.ResponseWriter, r *http.Request, cookieOpts sessioncookie.CookieOptions, opts Options) (*CookieSession, error) {
+	if err := cookieOpts.Validate(); err != nil {
+		return nil, err
+	}
+	cookie := &sessioncookie.Cookie{SessionCookie: &sessioncookie.SessionCookie{Name: name + "_session", Resp: w, Req: r}, Options: cookieOpts}
+	authCookie := &sessioncookie.Cookie{SessionCookie: &sessioncookie.SessionCookie{Name: name + "_auth", Resp: w, Req: r}, Options: cookieOpts}
+	t, err := a.OpenTransportSessionWithOptions(ctx, cookie, authCookie, store, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &CookieSession{t}, nil
 }
 
 func (c *CookieSession) RemoveCookie() {
-	c.cookie.Remove()
-	c.authCookie.Remove()
+	c.RemoveTokens()
 }
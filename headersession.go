@@ -0,0 +1,44 @@
+package httpsession
+
+import (
+	"context"
+	"github.com/timob/httpsession/store"
+	"github.com/timob/httpsession/token/headertoken"
+	"net/http"
+)
+
+// HeaderSession is like CookieSession, for clients that send tokens in
+// headers instead of cookies. The session token is read from
+// "Authorization: Bearer <token>" and the auth token from a header of its own,
+// see headertoken.Headers. Save sends both back in response headers, which
+// the client must use for its next request as the auth token is rotated.
+type HeaderSession struct {
+	*TransportSession
+}
+
+func OpenHeaderSession(store store.SessionEntryStore, w http.ResponseWriter, r *http.Request) (*HeaderSession, error) {
+	return DeaultAuthTimeout.OpenHeaderSession(store, w, r)
+}
+
+func (a AuthTimeout) OpenHeaderSession(store store.SessionEntryStore, w http.ResponseWriter, r *http.Request) (*HeaderSession, error) {
+	return a.OpenHeaderSessionWithOptions(context.Background(), store, w, r, headertoken.DefaultHeaders, Options{})
+}
+
+// OpenHeaderSessionWithOptions reads and sends the tokens in the headers
+// named by headers, which must pass headertoken.Headers.Validate.
+func OpenHeaderSessionWithOptions(ctx context.Context, store store.SessionEntryStore, w http.ResponseWriter, r *http.Request, headers headertoken.Headers, opts Options) (*HeaderSession, error) {
+	return DeaultAuthTimeout.OpenHeaderSessionWithOptions(ctx, store, w, r, headers, opts)
+}
+
+func (a AuthTimeout) OpenHeaderSessionWithOptions(ctx context.Context, store store.SessionEntryStore, w http.ResponseWriter, r *http.Request, headers headertoken.Headers, opts Options) (*HeaderSession, error) {
+	if err := headers.Validate(); err != nil {
+		return nil, err
+	}
+	header := headertoken.Bearer(headers.Session, w, r)
+	authHeader := &headertoken.HeaderToken{Name: headers.AuthRequest, ResponseName: headers.AuthResponse, Resp: w, Req: r}
+	t, err := a.OpenTransportSessionWithOptions(ctx, header, authHeader, store, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &HeaderSession{t}, nil
+}
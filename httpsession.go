@@ -3,6 +3,7 @@ package httpsession
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
@@ -12,12 +13,42 @@ import (
 	"fmt"
 	"github.com/timob/httpsession/store"
 	"github.com/timob/httpsession/token"
+	"github.com/timob/httpsession/token/signed"
 	"io"
 	"log"
 	"reflect"
 	"time"
 )
 
+// ErrConflict is returned by Save when the session was written by another
+// request since it was loaded. See Session.OnConflict.
+var ErrConflict = errors.New("session was changed by another request")
+
+var (
+	// ErrNotFound is returned when a session value doesn't exist.
+	ErrNotFound = errors.New("session value not found")
+	// ErrTypeMismatch is returned when a session value can't be converted to
+	// the requested type.
+	ErrTypeMismatch = errors.New("session value has a different type")
+	// ErrInvalidAuthToken is returned when opening a session with an auth
+	// token that doesn't match the session.
+	ErrInvalidAuthToken = errors.New("invalid authentication token")
+	// ErrStore wraps errors returned by the session store. The store's error
+	// can be found with errors.Is and errors.As as well.
+	ErrStore = errors.New("session store error")
+)
+
+func storeError(err error) error {
+	// a cancelled request is not a store failure
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrStore, err)
+}
+
+// maxMergeAttempts limits how often Save retries after a conflict.
+const maxMergeAttempts = 3
+
 // retryTimeout Small duration after authToken timeout, where old token will be honored.
 // It is to allow for first reply(s) after token change to be lost.
 var retryTimeout time.Duration = time.Minute * 1
@@ -38,8 +69,16 @@ func (r *randomKey) GenerateSessionKey() (key string, err error) {
 type sessionData struct {
 	key string
 	store.SessionEntryStore
+	ctxStore       store.ContextSessionEntryStore
+	ctx            context.Context
 	SessionTimeout time.Duration
 	session        session
+	// version of the entry when it was loaded, for CASStore
+	version uint64
+	// lock held on lockKey, for Locker
+	lockKey   string
+	lockToken string
+	policy    Policy
 }
 
 func (s *sessionData) SetSessionTimeout(t time.Duration) {
@@ -48,26 +87,62 @@ func (s *sessionData) SetSessionTimeout(t time.Duration) {
 
 func (s *sessionData) SetStore(e store.SessionEntryStore) {
 	s.SessionEntryStore = e
+	s.ctxStore = store.WithContext(e)
+}
+
+func (s *sessionData) SetPolicy(p Policy) {
+	s.policy = p
+}
+
+// Expiry returns the entry expiry for a save now, limited by the policy.
+func (s *sessionData) Expiry() time.Time {
+	timeout := s.SessionTimeout
+	if p := s.policy.IdleTimeout; p > 0 && timeout > p {
+		timeout = p
+	}
+	expiry := time.Now().Add(timeout)
+	if p := s.policy.MaxLifetime; p > 0 {
+		if end := s.session.CreatedAt().Add(p); end.Before(expiry) {
+			expiry = end
+		}
+	}
+	return expiry
+}
+
+func (s *sessionData) SetContext(ctx context.Context) {
+	s.ctx = ctx
+}
+
+func (s *sessionData) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
 }
 
 func (s *sessionData) SetKey(k string) {
 	s.key = k
+	s.version = 0
 }
 
 func (s *sessionData) Key() string {
-	s.session.SetLastError(nil)
 	return s.key
 }
 
 func (s *sessionData) LoadSession() (ok bool, err error) {
-	entry, ok, err := s.FindEntry(s.key)
+	if s.key == "" {
+		// new session, or a token that failed verification
+		return false, nil
+	}
+	entry, ok, err := s.ctxStore.FindEntryContext(s.context(), s.key)
 	if err != nil {
-		return
+		return false, storeError(err)
 	}
 
 	if !ok || time.Now().After(entry.SessionExpiry) {
 		return false, nil
 	}
+	s.version = entry.Version
 
 	buf := bytes.NewBuffer(entry.Data)
 	s.session.NewDecoder(buf)
@@ -76,6 +151,57 @@ func (s *sessionData) LoadSession() (ok bool, err error) {
 	if err != nil {
 		ok = false
 	}
+	if ok && !s.policy.valid(s.session.CreatedAt()) {
+		return false, nil
+	}
+	return
+}
+
+// LockSession takes the store lock on the session key. A session without a
+// key is new, no other request can use it, so it isn't locked.
+func (s *sessionData) LockSession(timeout, lease time.Duration) (err error) {
+	if s.key == "" {
+		return
+	}
+	locker, ok := s.SessionEntryStore.(store.Locker)
+	if !ok {
+		return store.ErrNotSupported
+	}
+
+	ctx := s.context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	lockToken, err := locker.LockEntry(ctx, s.key, lease)
+	if err != nil {
+		if err == context.DeadlineExceeded && s.context().Err() == nil {
+			err = ErrLockTimeout
+		}
+		return
+	}
+	s.lockKey, s.lockToken = s.key, lockToken
+	return
+}
+
+func (s *sessionData) UnlockSession() error {
+	if s.lockToken == "" {
+		return nil
+	}
+	key, lockToken := s.lockKey, s.lockToken
+	s.lockKey, s.lockToken = "", ""
+	return storeError(s.SessionEntryStore.(store.Locker).UnlockEntry(key, lockToken))
+}
+
+// ReloadSession loads the session again after a conflicting write.
+func (s *sessionData) ReloadSession() (err error) {
+	s.session.PrepareReload()
+	ok, err := s.LoadSession()
+	if err == nil && !ok {
+		// deleted or expired, don't bring it back
+		err = ErrConflict
+	}
 	return
 }
 
@@ -84,6 +210,7 @@ func (s *sessionData) NewSession() (err error) {
 	if err != nil {
 		return
 	}
+	s.version = 0
 	return s.session.NewSessionValues()
 }
 
@@ -101,7 +228,54 @@ func (s *sessionData) SaveSession() (err error) {
 		return
 	}
 
-	return s.AddEntry(s.key, &store.SessionEntry{buf.Bytes(), time.Now().Add(s.SessionTimeout)})
+	entry := &store.SessionEntry{Data: buf.Bytes(), SessionExpiry: s.Expiry()}
+	if cas, ok := s.SessionEntryStore.(store.CASStore); ok {
+		if err = s.context().Err(); err != nil {
+			return
+		}
+		ok, err = cas.CompareAndSwapEntry(s.key, s.version, entry)
+		if err == nil {
+			if !ok {
+				return ErrConflict
+			}
+			s.version = entry.Version
+			s.session.MarkClean()
+			return
+		}
+		// decorators report ErrNotSupported when the store they wrap
+		// isn't a CASStore
+		if !errors.Is(err, store.ErrNotSupported) {
+			return storeError(err)
+		}
+	}
+	err = s.ctxStore.AddEntryContext(s.context(), s.key, entry)
+	if err != nil {
+		return storeError(err)
+	}
+	s.session.MarkClean()
+	return
+}
+
+// TouchSession extends the entry expiry if the store can do so without a
+// rewrite, otherwise it saves the session.
+func (s *sessionData) TouchSession() (err error) {
+	if err = s.context().Err(); err != nil {
+		return
+	}
+	if !s.session.MustSave() {
+		ok, err := store.Touch(s.SessionEntryStore, s.key, s.Expiry())
+		if err != nil || ok {
+			return storeError(err)
+		}
+	}
+	return s.SaveSession()
+}
+
+func (s *sessionData) DeleteSession() error {
+	if err := s.context().Err(); err != nil {
+		return err
+	}
+	return storeError(store.Delete(s.SessionEntryStore, s.key))
 }
 
 type sessionGob struct {
@@ -142,6 +316,7 @@ func (s *sessionJSON) Encode(v interface{}) error {
 
 func (s *sessionJSON) NewDecoder(r io.Reader) {
 	s.dec = json.NewDecoder(r)
+	s.dec.UseNumber()
 }
 
 func (s *sessionJSON) Decode(v interface{}) error {
@@ -192,7 +367,9 @@ func (s *sessionJSONObject) Decode(v interface{}) (err error) {
 	}
 
 	if rawJson, ok := s.raw[name]; ok {
-		err = json.NewDecoder(bytes.NewBuffer(rawJson)).Decode(v)
+		dec := json.NewDecoder(bytes.NewBuffer(rawJson))
+		dec.UseNumber()
+		err = dec.Decode(v)
 		if err != nil {
 			return
 		}
@@ -239,71 +416,166 @@ func (s *sessionCodecLog) FinishEncode() (err error) {
 type sessionValues struct {
 	Values    map[string]interface{}
 	Timestamp time.Time
-	session   session `json:"-"`
+	// Types records the type of numeric values, and of values with a type
+	// passed to RegisterType, which the JSON codecs can't restore on their
+	// own.
+	Types map[string]string `json:",omitempty"`
+	// Created is when the session was created, for Policy.MaxLifetime.
+	Created time.Time
+	session session `json:"-"`
+
+	// dirty is set by SetVar and Clear. Once the map has been handed out by
+	// SValues or Var it may be changed directly, so it is compared with a
+	// hash taken when it was loaded or saved.
+	dirty    bool
+	exposed  bool
+	snapshot [sha256.Size]byte
+	// exact holds maps and slices as decoded by the JSON codecs, with
+	// their numbers still json.Number, so that GetInto and Get can convert
+	// integers that don't fit in a float64.
+	exact map[string]interface{}
 }
 
 func (s *sessionValues) LoadSessionValues() (err error) {
-	return s.session.Decode(s)
+	err = s.session.Decode(s)
+	s.exact = nil
+	for k, v := range s.Values {
+		s.Values[k] = restoreValue(v, s.Types[k])
+		switch s.Values[k].(type) {
+		case map[string]interface{}, []interface{}:
+			if hasNumbers(v) {
+				if s.exact == nil {
+					s.exact = make(map[string]interface{})
+				}
+				s.exact[k] = v
+			}
+		}
+	}
+	s.MarkClean()
+	return
+}
+
+// exactValue returns the value named key as it was decoded, if it holds
+// numbers and hasn't been changed since.
+func (s *sessionValues) exactValue(key string) (interface{}, bool) {
+	e, ok := s.exact[key]
+	if !ok || !reflect.DeepEqual(restoreValue(e, ""), s.Values[key]) {
+		return nil, false
+	}
+	return e, true
+}
+
+func (s *sessionValues) MarkClean() {
+	s.dirty = false
+	if s.exposed {
+		s.exposed = false
+		s.expose()
+	}
+}
+
+// Changed reports whether the values changed since they were loaded or saved.
+func (s *sessionValues) Changed() bool {
+	if s.dirty {
+		return true
+	}
+	if s.exposed {
+		h, ok := s.hashValues()
+		return !ok || h != s.snapshot
+	}
+	return false
+}
+
+func (s *sessionValues) expose() {
+	if s.exposed {
+		return
+	}
+	var ok bool
+	s.snapshot, ok = s.hashValues()
+	s.exposed = true
+	if !ok {
+		// can't tell, always save
+		s.dirty = true
+	}
+}
+
+func (s *sessionValues) hashValues() (h [sha256.Size]byte, ok bool) {
+	b, err := json.Marshal(s.Values)
+	if err != nil {
+		return h, false
+	}
+	return sha256.Sum256(b), true
 }
 
 func (s *sessionValues) SaveSessionValues() error {
 	s.Timestamp = time.Now()
+	s.Types = typeTags(s.Values)
 	return s.session.Encode(s)
 }
 
 func (s *sessionValues) NewSessionValues() (err error) {
 	s.Values = make(map[string]interface{})
+	s.Created = time.Now()
 	return
 }
 
+func (s *sessionValues) CreatedAt() time.Time {
+	return s.Created
+}
+
+func (s *sessionValues) SetCreatedAt(t time.Time) {
+	s.Created = t
+	s.dirty = true
+}
+
+func (s *sessionValues) MustSave() bool {
+	return false
+}
+
+func (s *sessionValues) PrepareReload() {
+	s.Clear()
+}
+
 func (s *sessionValues) SValues() map[string]interface{} {
+	s.expose()
 	return s.Values
 }
 
+// Clear removes all values. The session keeps its creation time.
 func (s *sessionValues) Clear() {
-	s.NewSessionValues()
+	s.Values = make(map[string]interface{})
+	s.exact = nil
+	s.dirty = true
 }
 
 func (s *sessionValues) SetVar(key string, i interface{}) {
 	s.Values[key] = i
+	delete(s.exact, key)
+	s.dirty = true
 }
 
-func (s *sessionValues) GetVal(key string, dst interface{}) {
-	i, ok := s.Values[key]
+// Lookup returns the value named key. If there is no such value ok is false
+// and err is ErrNotFound.
+func (s *sessionValues) Lookup(key string) (i interface{}, ok bool, err error) {
+	i, ok = s.Values[key]
 	if !ok {
-		s.session.SetLastError(fmt.Errorf("unkown session value named: %s", key))
-		return
+		return nil, false, fmt.Errorf("%w: %s", ErrNotFound, key)
 	}
+	// the caller may change a map or slice value
+	s.expose()
+	return i, true, nil
+}
 
-	f, ok := i.(float64)
+// getVal stores the value named key in dst, a pointer to one of the types
+// returned by the IntVar family.
+func (s *sessionValues) getVal(key string, dst interface{}) error {
+	i, ok := s.Values[key]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
 
 	switch v := dst.(type) {
-	case *int:
-		if ok {
-			*v = int(f)
-		} else {
-			*v, ok = i.(int)
-		}
-	case *uint:
-		if ok {
-			*v = uint(f)
-		} else {
-			*v, ok = i.(uint)
-		}
-	case *int64:
-		if ok {
-			*v = int64(f)
-		} else {
-			*v, ok = i.(int64)
-		}
-	case *uint64:
-		if ok {
-			*v = uint64(f)
-		} else {
-			*v, ok = i.(uint64)
-		}
-	case *float64:
-		*v, ok = i.(float64)
+	case *int, *uint, *int64, *uint64, *float64:
+		ok = setNumber(v, i)
 	case *bool:
 		*v, ok = i.(bool)
 	case *string:
@@ -312,12 +584,33 @@ func (s *sessionValues) GetVal(key string, dst interface{}) {
 		*v = i
 	}
 	if !ok {
-		s.session.SetLastError(fmt.Errorf("session value unkown type %T", i))
+		return fmt.Errorf("%w: %s is %T, not %T", ErrTypeMismatch, key, i, reflect.ValueOf(dst).Elem().Interface())
 	}
+	return nil
+}
 
-	s.session.SetLastError(nil)
-	//	log.Printf("here2 %v, ok %v", *val.(*int), ok)
-	return
+// GetVal stores the value named key in dst, recording any error for
+// GetLastError.
+func (s *sessionValues) GetVal(key string, dst interface{}) {
+	s.session.SetLastError(s.getVal(key, dst))
+}
+
+// GetInto stores the value named key in dst, which must be a non-nil
+// pointer. Values of a type not passed to RegisterType are converted with a
+// JSON round trip, so a struct can be read from the map the JSON codecs
+// decode it to. The round trip starts from the decoded numbers, so integers
+// beyond 2^53 are not rounded.
+func (s *sessionValues) GetInto(key string, dst interface{}) {
+	i, _, err := s.Lookup(key)
+	if err == nil {
+		if e, ok := s.exactValue(key); ok {
+			i = e
+		}
+		if err = convertValue(i, dst); err != nil {
+			err = fmt.Errorf("%w: %s: %v", ErrTypeMismatch, key, err)
+		}
+	}
+	s.session.SetLastError(err)
 }
 
 func (s *sessionValues) IntVar(key string) (v int) {
@@ -356,6 +649,7 @@ func (s *sessionValues) StringVar(key string) (v string) {
 }
 
 func (s *sessionValues) Var(key string) (v interface{}) {
+	s.expose()
 	s.GetVal(key, &v)
 	return
 }
@@ -407,6 +701,7 @@ type sessionAuth struct {
 	updateAuthStartTimeOnSave bool
 	authSession               `json:"-"`
 	inGracePeriod             bool
+	requestAuthStr            string
 }
 
 func (s *sessionAuth) NewSessionValues() (err error) {
@@ -419,6 +714,7 @@ func (s *sessionAuth) NewSessionValues() (err error) {
 }
 
 func (s *sessionAuth) LoadSessionValues() (err error) {
+	s.requestAuthStr = s.authSession.AuthStr()
 	err = s.authSession.LoadSessionValues()
 	if err != nil {
 		return
@@ -439,7 +735,7 @@ func (s *sessionAuth) LoadSessionValues() (err error) {
 		s.authSession.SetInGracePeriod(true)
 		// ok
 	} else {
-		return errors.New("invalid authentication token")
+		return ErrInvalidAuthToken
 	}
 
 	s.authSession.SetAuthStr(s.CalcAuth(0))
@@ -469,6 +765,21 @@ func (s *sessionAuth) SaveSessionValues() (err error) {
 	return s.authSession.Encode(s)
 }
 
+// PrepareReload restores the auth token sent with the request so that it is
+// checked again against the reloaded secret.
+func (s *sessionAuth) PrepareReload() {
+	s.authSession.SetAuthStr(s.requestAuthStr)
+	s.authSession.SetInGracePeriod(false)
+	s.updateAuthStartTimeOnSave = false
+	s.authSession.PrepareReload()
+}
+
+// MustSave reports whether the auth secret changed since loading, in which case
+// the entry can't just be touched.
+func (s *sessionAuth) MustSave() bool {
+	return s.updateAuthStartTimeOnSave || (s.AuthStart == time.Time{})
+}
+
 func (s *sessionAuth) InGracePeriod() bool {
 	return s.inGracePeriod
 }
@@ -510,8 +821,22 @@ type session interface {
 	sessionExternal
 	SetKey(string)
 	SetSessionTimeout(time.Duration)
+	Expiry() time.Time
+	SetContext(context.Context)
+	SetPolicy(Policy)
+	CreatedAt() time.Time
+	SetCreatedAt(time.Time)
 	LoadSession() (bool, error)
 	SaveSession() error
+	TouchSession() error
+	DeleteSession() error
+	MustSave() bool
+	ReloadSession() error
+	PrepareReload()
+	Changed() bool
+	MarkClean()
+	LockSession(timeout, lease time.Duration) error
+	UnlockSession() error
 	NewSession() error
 	GenerateSessionKey() (string, error)
 	LoadSessionValues() (err error)
@@ -555,6 +880,9 @@ type sessionExternal interface {
 	BoolVar(key string) (v bool)
 	StringVar(key string) (v string)
 	Var(key string) (v interface{})
+	GetInto(key string, dst interface{})
+	Lookup(key string) (v interface{}, ok bool, err error)
+	exactValue(key string) (interface{}, bool)
 	Clear()
 	GetLastError() error
 	DurationSinceLastUpdate() time.Duration
@@ -564,13 +892,78 @@ type sessionExternal interface {
 type Session struct {
 	sessionExternal
 	sessionInternal session
+	merge           func(*Session) error
+	signer          *signed.Signer
 }
 
-func (s *Session) Save(sessionTimeout time.Duration) {
+// SaveContext is like Save, but uses ctx for this and later store calls
+// instead of the context the session was opened with.
+func (s *Session) SaveContext(ctx context.Context, sessionTimeout time.Duration) error {
+	s.sessionInternal.SetContext(ctx)
+	return s.Save(sessionTimeout)
+}
+
+// Save writes the session to the store. If no values changed since the
+// session was loaded, only the expiry is extended when the store supports
+// it, see Touch. The error is also recorded for GetLastError.
+func (s *Session) Save(sessionTimeout time.Duration) error {
 	var err error
 	s.sessionInternal.SetSessionTimeout(sessionTimeout)
-	err = s.sessionInternal.SaveSession()
+	if s.sessionInternal.Changed() {
+		err = s.sessionInternal.SaveSession()
+	} else {
+		err = s.sessionInternal.TouchSession()
+	}
+	for i := 0; err == ErrConflict && s.merge != nil && i < maxMergeAttempts; i++ {
+		if err = s.sessionInternal.ReloadSession(); err != nil {
+			break
+		}
+		if err = s.merge(s); err != nil {
+			break
+		}
+		err = s.sessionInternal.SaveSession()
+	}
+	if unlockErr := s.sessionInternal.UnlockSession(); err == nil {
+		err = unlockErr
+	}
 	s.sessionInternal.SetLastError(err)
+	return err
+}
+
+// OnConflict sets a function used by Save when the store implements
+// store.CASStore and another request saved the session first. The session is
+// reloaded with the other request's values, merge is called to apply this
+// request's changes again, and the save is retried. Without a merge function
+// Save returns ErrConflict.
+func (s *Session) OnConflict(merge func(s *Session) error) {
+	s.merge = merge
+}
+
+// Touch extends the session expiry without rewriting its values if the store
+// implements store.Toucher. Otherwise it is the same as Save.
+func (s *Session) Touch(sessionTimeout time.Duration) error {
+	s.sessionInternal.SetSessionTimeout(sessionTimeout)
+	err := s.sessionInternal.TouchSession()
+	if unlockErr := s.sessionInternal.UnlockSession(); err == nil {
+		err = unlockErr
+	}
+	s.sessionInternal.SetLastError(err)
+	return err
+}
+
+// Close releases the session lock taken by SessionLock without saving. It
+// does nothing for sessions opened without a lock.
+func (s *Session) Close() error {
+	err := s.sessionInternal.UnlockSession()
+	s.sessionInternal.SetLastError(err)
+	return err
+}
+
+// Delete removes the session entry from the store.
+func (s *Session) Delete() error {
+	err := s.sessionInternal.DeleteSession()
+	s.sessionInternal.SetLastError(err)
+	return err
 }
 
 func (s *Session) Recreate() (sessionIdToken token.Token) {
@@ -580,7 +973,7 @@ func (s *Session) Recreate() (sessionIdToken token.Token) {
 		return nil
 	}
 	s.sessionInternal.SetKey(key)
-	return token.TokenStr(key)
+	return signToken(s.signer, key)
 }
 
 func (s *Session) Values() map[string]interface{} {
@@ -593,6 +986,73 @@ type AuthSession struct {
 }
 
 func OpenSession(idToken token.Token, store store.SessionEntryStore) (sessionR *Session, sessionIdToken token.Token, err error) {
+	return OpenSessionContext(context.Background(), idToken, store)
+}
+
+// OpenSessionContext is like OpenSession, but store calls made while opening
+// and saving the session are cancelled when ctx is done. Stores that don't
+// implement store.ContextSessionEntryStore only check ctx before each call.
+func OpenSessionContext(ctx context.Context, idToken token.Token, store store.SessionEntryStore) (sessionR *Session, sessionIdToken token.Token, err error) {
+	return OpenSessionWithOptions(ctx, idToken, store, Options{})
+}
+
+// Options configure how a session is opened.
+type Options struct {
+	// Codec encodes sessions when they are saved. Sessions written with any
+	// registered codec can be read, so the codec can be changed without
+	// ending live sessions. Defaults to JSONObjectCodec.
+	Codec CodecID
+	// Lock, if set, locks the session as described for SessionLock.
+	Lock *SessionLock
+	// Policy limits the session lifetime.
+	Policy Policy
+	// Signer, if set, signs the session id tokens returned by the open
+	// functions and Recreate. Tokens that fail verification are treated as
+	// empty without a store lookup, so a new session is created.
+	Signer *signed.Signer
+}
+
+// verifyToken returns the session id in t, or the empty token if t isn't
+// signed by signer.
+func verifyToken(signer *signed.Signer, t token.Token) token.Token {
+	if signer == nil {
+		return t
+	}
+	id, _ := signer.Verify(t)
+	return id
+}
+
+func signToken(signer *signed.Signer, key string) token.Token {
+	if signer == nil {
+		return token.TokenStr(key)
+	}
+	return signer.Sign(token.TokenStr(key))
+}
+
+// Policy limits how long a session can be used. Sessions past either limit
+// are not loaded, a new session is created instead. Zero values mean no
+// limit.
+type Policy struct {
+	// IdleTimeout ends a session that isn't saved or touched for this long.
+	// Timeouts passed to Save and Touch are capped to it.
+	IdleTimeout time.Duration
+	// MaxLifetime ends a session this long after it was created, however
+	// often it is saved. Sessions saved before creation times were stored
+	// have none and are ended when MaxLifetime is set.
+	MaxLifetime time.Duration
+}
+
+// valid reports whether a session created at created is within the maximum
+// lifetime. The idle timeout is enforced by the entry expiry.
+func (p Policy) valid(created time.Time) bool {
+	return p.MaxLifetime <= 0 || time.Now().Before(created.Add(p.MaxLifetime))
+}
+
+func OpenSessionWithOptions(ctx context.Context, idToken token.Token, store store.SessionEntryStore, opts Options) (sessionR *Session, sessionIdToken token.Token, err error) {
+	codec, err := newSessionCodecSelect(opts.Codec)
+	if err != nil {
+		return
+	}
 	var handle sessionHandle
 	session := &struct {
 		*sessionData
@@ -600,26 +1060,36 @@ func OpenSession(idToken token.Token, store store.SessionEntryStore) (sessionR *
 		*sessionValues
 		*randomKey
 		*sessionError
-	}{&sessionData{session: &handle}, &sessionJSONObject{}, &sessionValues{session: &handle}, &randomKey{session: &handle}, &sessionError{}}
+	}{&sessionData{session: &handle}, codec, &sessionValues{session: &handle}, &randomKey{session: &handle}, &sessionError{}}
 	handle.session = session
 
-	session.SetKey(idToken.String())
+	session.SetKey(verifyToken(opts.Signer, idToken).String())
 	session.SetStore(store)
-	ok, err := session.LoadSession()
+	session.SetContext(ctx)
+	session.SetPolicy(opts.Policy)
+	err = loadOrNewSession(session, opts.Lock)
 	if err != nil {
 		return
 	}
-	if !ok {
-		err = session.NewSession()
-		if err != nil {
-			return
-		}
-	}
 
-	return &Session{session, session}, token.TokenStr(session.Key()), nil
+	return &Session{sessionExternal: session, sessionInternal: session, signer: opts.Signer}, signToken(opts.Signer, session.Key()), nil
 }
 
 func OpenSessionWithAuth(idToken token.Token, authToken token.Token, authTokenTimeout time.Duration, store store.SessionEntryStore) (sessionR *AuthSession, sessionIdToken token.Token, sessionAuthToken token.Token, err error) {
+	return OpenSessionWithAuthContext(context.Background(), idToken, authToken, authTokenTimeout, store)
+}
+
+// OpenSessionWithAuthContext is like OpenSessionWithAuth, with store calls
+// cancelled as for OpenSessionContext.
+func OpenSessionWithAuthContext(ctx context.Context, idToken token.Token, authToken token.Token, authTokenTimeout time.Duration, store store.SessionEntryStore) (sessionR *AuthSession, sessionIdToken token.Token, sessionAuthToken token.Token, err error) {
+	return OpenSessionWithAuthOptions(ctx, idToken, authToken, authTokenTimeout, store, Options{})
+}
+
+func OpenSessionWithAuthOptions(ctx context.Context, idToken token.Token, authToken token.Token, authTokenTimeout time.Duration, store store.SessionEntryStore, opts Options) (sessionR *AuthSession, sessionIdToken token.Token, sessionAuthToken token.Token, err error) {
+	codec, err := newSessionCodecSelect(opts.Codec)
+	if err != nil {
+		return
+	}
 	var handle authSessionHandle
 	authSession := &struct {
 		*sessionData
@@ -632,31 +1102,31 @@ func OpenSessionWithAuth(idToken token.Token, authToken token.Token, authTokenTi
 		&sessionData{session: &sessionAuth{authSession: &handle}},
 		&sessionAuthParam{},
 		&sessionValues{session: &handle},
-		&sessionJSONObject{},
+		codec,
 		&randomKey{session: &handle},
 		&sessionError{},
 	}
 	handle.authSession = authSession
 
-	authSession.SetKey(idToken.String())
+	authSession.SetKey(verifyToken(opts.Signer, idToken).String())
 	authSession.SetStore(store)
 	authSession.SetAuthStr(authToken.String())
 	authSession.SetAuthStrTimeout(authTokenTimeout)
-	ok, err := authSession.LoadSession()
+	authSession.SetContext(ctx)
+	authSession.SetPolicy(opts.Policy)
+	err = loadOrNewSession(authSession, opts.Lock)
 	if err != nil {
 		return
 	}
-	if !ok {
-		err = authSession.NewSession()
-		if err != nil {
-			return
-		}
-	}
 
-	return &AuthSession{&Session{authSession, authSession}, authSession}, token.TokenStr(authSession.Key()), token.TokenStr(authSession.AuthStr()), nil
+	return &AuthSession{&Session{sessionExternal: authSession, sessionInternal: authSession, signer: opts.Signer}, authSession}, signToken(opts.Signer, authSession.Key()), token.TokenStr(authSession.AuthStr()), nil
 }
 
 func FindSessionValuesByKey(key string, store store.SessionEntryStore) (vals map[string]interface{}, ok bool, err error) {
+	codec, err := newSessionCodecSelect(0)
+	if err != nil {
+		return
+	}
 	var handle sessionHandle
 	session := &struct {
 		*sessionData
@@ -664,7 +1134,7 @@ func FindSessionValuesByKey(key string, store store.SessionEntryStore) (vals map
 		sessionCodec
 		*sessionError
 		*randomKey
-	}{&sessionData{session: &handle}, &sessionValues{session: &handle}, &sessionJSONObject{}, &sessionError{}, nil}
+	}{&sessionData{session: &handle}, &sessionValues{session: &handle}, codec, &sessionError{}, nil}
 	handle.session = session
 
 	session.SetKey(key)
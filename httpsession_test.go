@@ -1,11 +1,23 @@
 package httpsession
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/timob/httpsession/store"
+	"github.com/timob/httpsession/store/encryptstore"
 	"github.com/timob/httpsession/store/mapstore"
+	"github.com/timob/httpsession/token"
+	"github.com/timob/httpsession/token/headertoken"
 	"github.com/timob/httpsession/token/sessioncookie"
+	"github.com/timob/httpsession/token/signed"
+	"math"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -108,3 +120,959 @@ func TestAuthSessionCookie(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSessionTouchDelete(t *testing.T) {
+	store := mapstore.NewMapSessionStore()
+	session, tok, err := OpenSession(token.EmptyToken, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// new session has no entry yet, so touch must save it
+	session.SetVar("hello", "world")
+	session.Touch(time.Minute)
+	if err = session.GetLastError(); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok, _ := store.FindEntry(tok.String())
+	if !ok {
+		t.Fatal("expected touch to save new session")
+	}
+	data := string(entry.Data)
+
+	session, _, err = OpenSession(tok, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.SetVar("hello", "changed")
+	session.Touch(time.Hour)
+	entry, _, _ = store.FindEntry(tok.String())
+	if string(entry.Data) != data {
+		t.Fatal("expected touch not to rewrite session values")
+	}
+	if entry.SessionExpiry.Before(time.Now().Add(time.Minute * 59)) {
+		t.Fatal("expected touch to extend expiry")
+	}
+
+	session.Delete()
+	if _, ok, _ = store.FindEntry(tok.String()); ok {
+		t.Fatal("expected session entry to be deleted")
+	}
+}
+
+func TestSessionContext(t *testing.T) {
+	store := mapstore.NewMapSessionStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	session, tok, err := OpenSessionContext(ctx, token.EmptyToken, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	session.Save(time.Minute)
+	if err = session.GetLastError(); err != context.Canceled {
+		t.Fatalf("expected save with cancelled context to fail, got %v", err)
+	}
+	session.SaveContext(context.Background(), time.Minute)
+	if err = session.GetLastError(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = OpenSessionContext(ctx, tok, store); err != context.Canceled {
+		t.Fatalf("expected open with cancelled context to fail, got %v", err)
+	}
+
+	session, _, _ = OpenSession(token.EmptyToken, timeoutStore{store})
+	err = session.Save(time.Minute)
+	if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrStore) {
+		t.Fatalf("expected wrapped deadline error not to be a store error, got %v", err)
+	}
+}
+
+func TestSessionConflict(t *testing.T) {
+	store := mapstore.NewMapSessionStore()
+	session, tok, _ := OpenSession(token.EmptyToken, store)
+	session.SetVar("cart", "a")
+	session.Save(time.Minute)
+
+	first, _, _ := OpenSession(tok, store)
+	second, _, _ := OpenSession(tok, store)
+	first.SetVar("cart", first.StringVar("cart")+"b")
+	first.Save(time.Minute)
+	if err := first.GetLastError(); err != nil {
+		t.Fatal(err)
+	}
+	second.SetVar("cart", second.StringVar("cart")+"c")
+	second.Save(time.Minute)
+	if err := second.GetLastError(); err != ErrConflict {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+
+	second.OnConflict(func(s *Session) error {
+		s.SetVar("cart", s.StringVar("cart")+"c")
+		return nil
+	})
+	second.Save(time.Minute)
+	if err := second.GetLastError(); err != nil {
+		t.Fatal(err)
+	}
+	session, _, _ = OpenSession(tok, store)
+	if v := session.StringVar("cart"); v != "abc" {
+		t.Fatalf("expected merged value abc, got %s", v)
+	}
+}
+
+func TestSessionConflictWrapped(t *testing.T) {
+	store, err := encryptstore.NewEncryptSessionStore(mapstore.NewMapSessionStore(), encryptstore.Key{ID: 1, Secret: make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, tok, _ := OpenSession(token.EmptyToken, store)
+	session.SetVar("cart", "a")
+	session.Save(time.Minute)
+
+	first, _, _ := OpenSession(tok, store)
+	second, _, _ := OpenSession(tok, store)
+	first.SetVar("cart", "b")
+	first.Save(time.Minute)
+	second.SetVar("cart", "c")
+	second.Save(time.Minute)
+	if err := second.GetLastError(); err != ErrConflict {
+		t.Fatalf("expected ErrConflict through a wrapping store, got %v", err)
+	}
+}
+
+func TestAuthSessionConflict(t *testing.T) {
+	store := mapstore.NewMapSessionStore()
+	session, tok, authTok, _ := OpenSessionWithAuth(token.EmptyToken, token.EmptyToken, time.Minute, store)
+	session.Save(time.Minute)
+
+	first, _, _, err := OpenSessionWithAuth(tok, authTok, time.Minute, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, _, err := OpenSessionWithAuth(tok, authTok, time.Minute, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.SetVar("a", 1)
+	first.Save(time.Minute)
+	second.OnConflict(func(s *Session) error {
+		s.SetVar("b", 2)
+		return nil
+	})
+	second.SetVar("b", 2)
+	second.Save(time.Minute)
+	if err = second.GetLastError(); err != nil {
+		t.Fatal(err)
+	}
+
+	session, _, _, err = OpenSessionWithAuth(tok, authTok, time.Minute, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.IntVar("a") != 1 || session.IntVar("b") != 2 {
+		t.Fatal("expected both requests' values to be saved")
+	}
+}
+
+func TestSessionLock(t *testing.T) {
+	store := mapstore.NewMapSessionStore()
+	lock := SessionLock{Timeout: time.Second}
+	ctx := context.Background()
+	session, tok, _ := OpenSession(token.EmptyToken, store)
+	session.SetVar("counter", 0)
+	session.Save(time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, _, err := lock.OpenSession(ctx, tok, store)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			session.SetVar("counter", session.IntVar("counter")+1)
+			session.Save(time.Minute)
+			if err = session.GetLastError(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	session, _, _ = OpenSession(tok, store)
+	if v := session.IntVar("counter"); v != 10 {
+		t.Fatalf("expected locked updates to be serialized, counter is %d", v)
+	}
+
+	held, _, _ := lock.OpenSession(ctx, tok, store)
+	lock.Timeout = time.Millisecond * 20
+	if _, _, err := lock.OpenSession(ctx, tok, store); err != ErrLockTimeout {
+		t.Fatalf("expected ErrLockTimeout, got %v", err)
+	}
+	held.Close()
+	if _, _, err := lock.OpenSession(ctx, tok, store); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingStore counts entry writes to the wrapped store.
+type countingStore struct {
+	*mapstore.MapSessionStore
+	adds int
+}
+
+func (c *countingStore) AddEntry(key string, entry *store.SessionEntry) error {
+	c.adds++
+	return c.MapSessionStore.AddEntry(key, entry)
+}
+
+func (c *countingStore) CompareAndSwapEntry(key string, version uint64, entry *store.SessionEntry) (bool, error) {
+	c.adds++
+	return c.MapSessionStore.CompareAndSwapEntry(key, version, entry)
+}
+
+func TestSessionDirtyTracking(t *testing.T) {
+	store := &countingStore{MapSessionStore: mapstore.NewMapSessionStore()}
+	session, tok, _ := OpenSession(token.EmptyToken, store)
+	session.Save(time.Minute)
+	if store.adds != 1 {
+		t.Fatalf("expected new session to be written, got %d writes", store.adds)
+	}
+
+	session, _, _ = OpenSession(tok, store)
+	session.StringVar("a")
+	session.Save(time.Hour)
+	if store.adds != 1 {
+		t.Fatal("expected read-only request not to rewrite the session")
+	}
+	entry, _, _ := store.FindEntry(tok.String())
+	if entry.SessionExpiry.Before(time.Now().Add(time.Minute * 59)) {
+		t.Fatal("expected read-only save to extend expiry")
+	}
+
+	session, _, _ = OpenSession(tok, store)
+	session.SetVar("a", "b")
+	session.Save(time.Hour)
+	if store.adds != 2 {
+		t.Fatal("expected SetVar to cause a write")
+	}
+
+	session, _, _ = OpenSession(tok, store)
+	session.Values()
+	session.Save(time.Hour)
+	if store.adds != 2 {
+		t.Fatal("expected unchanged Values map not to cause a write")
+	}
+	session.Values()["a"] = "c"
+	session.Save(time.Hour)
+	if store.adds != 3 {
+		t.Fatal("expected change through Values map to cause a write")
+	}
+	session.Save(time.Hour)
+	if store.adds != 3 {
+		t.Fatal("expected no write after changes were saved")
+	}
+}
+
+func TestRegisterCodecReserved(t *testing.T) {
+	for _, id := range []CodecID{0, JSONCodec, '{', 0xc0, 0xc2} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected codec id %#x to be rejected", byte(id))
+				}
+			}()
+			RegisterCodec(id, func() Codec { return &sessionJSON{} })
+		}()
+	}
+}
+
+func TestSessionCodecSwitch(t *testing.T) {
+	st := mapstore.NewMapSessionStore()
+	ctx := context.Background()
+	session, tok, err := OpenSessionWithOptions(ctx, token.EmptyToken, st, Options{Codec: GobCodec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.SetVar("a", "b")
+	session.Save(time.Minute)
+	if entry, _, _ := st.FindEntry(tok.String()); entry.Data[0] != byte(GobCodec) {
+		t.Fatal("expected entry to start with the gob codec id")
+	}
+
+	session, _, _ = OpenSessionWithOptions(ctx, tok, st, Options{Codec: JSONCodec})
+	if session.StringVar("a") != "b" {
+		t.Fatal("expected gob session to be read after switching codec")
+	}
+	session.SetVar("a", "c")
+	session.Save(time.Minute)
+	if entry, _, _ := st.FindEntry(tok.String()); entry.Data[0] != byte(JSONCodec) {
+		t.Fatal("expected entry to be rewritten with the json codec")
+	}
+
+	st.AddEntry("legacy", &store.SessionEntry{Data: []byte(`{"sessionValues":{"Values":{"a":"d"}}}`), SessionExpiry: time.Now().Add(time.Minute)})
+	vals, ok, err := FindSessionValuesByKey("legacy", st)
+	if err != nil || !ok || vals["a"] != "d" {
+		t.Fatalf("expected legacy entry to be read, got %v %v %v", vals, ok, err)
+	}
+
+	if _, _, err = OpenSessionWithOptions(ctx, tok, st, Options{Codec: 99}); err == nil {
+		t.Fatal("expected unknown codec to be rejected")
+	}
+}
+
+func TestSessionNumbers(t *testing.T) {
+	for name, codec := range map[string]CodecID{"Gob": GobCodec, "JSON": JSONCodec, "JSONObject": JSONObjectCodec} {
+		t.Run(name, func(t *testing.T) {
+			st := mapstore.NewMapSessionStore()
+			ctx := context.Background()
+			session, tok, _ := OpenSessionWithOptions(ctx, token.EmptyToken, st, Options{Codec: codec})
+			session.SetVar("maxInt64", int64(math.MaxInt64))
+			session.SetVar("minInt64", int64(math.MinInt64))
+			session.SetVar("maxUint64", uint64(math.MaxUint64))
+			session.SetVar("beyondFloat", int64(1<<53+1))
+			session.SetVar("int", 42)
+			session.SetVar("float", 1.5)
+			session.Save(time.Minute)
+
+			session, _, _ = OpenSessionWithOptions(ctx, tok, st, Options{Codec: codec})
+			if v := session.Int64Var("maxInt64"); v != math.MaxInt64 {
+				t.Errorf("maxInt64: got %d", v)
+			}
+			if v := session.Int64Var("minInt64"); v != math.MinInt64 {
+				t.Errorf("minInt64: got %d", v)
+			}
+			if v := session.Uint64Var("maxUint64"); v != math.MaxUint64 {
+				t.Errorf("maxUint64: got %d", v)
+			}
+			if v := session.Int64Var("beyondFloat"); v != 1<<53+1 {
+				t.Errorf("beyondFloat: got %d", v)
+			}
+			if v, ok := session.Var("int").(int); !ok || v != 42 {
+				t.Errorf("int: got %T %v", session.Var("int"), session.Var("int"))
+			}
+			if v := session.Int64Var("int"); v != 42 {
+				t.Errorf("int as int64: got %d", v)
+			}
+			if v := session.Float64Var("float"); v != 1.5 {
+				t.Errorf("float: got %v", v)
+			}
+			if v := session.IntVar("float"); v != 1 {
+				t.Errorf("float as int: got %v", v)
+			}
+		})
+	}
+
+	for name, codec := range map[string]CodecID{"JSON": JSONCodec, "JSONObject": JSONObjectCodec} {
+		t.Run(name+"Nested", func(t *testing.T) {
+			st := mapstore.NewMapSessionStore()
+			ctx := context.Background()
+			session, tok, _ := OpenSessionWithOptions(ctx, token.EmptyToken, st, Options{Codec: codec})
+			session.SetVar("ids", []int64{1<<53 + 1, -1<<53 - 1})
+			session.SetVar("m", map[string]interface{}{"id": int64(1<<53 + 1), "list": []uint64{math.MaxUint64}})
+			session.Save(time.Minute)
+
+			session, _, _ = OpenSessionWithOptions(ctx, tok, st, Options{Codec: codec})
+			if ids, ok := session.Var("ids").([]int64); !ok || ids[0] != 1<<53+1 || ids[1] != -1<<53-1 {
+				t.Errorf("ids: got %T %v", session.Var("ids"), session.Var("ids"))
+			}
+			if m := session.Var("m").(map[string]interface{}); m["id"] != float64(1<<53) {
+				t.Errorf("expected untyped nested number as float64, got %T %v", m["id"], m["id"])
+			}
+			var m struct {
+				ID   int64
+				List []uint64
+			}
+			session.GetInto("m", &m)
+			if err := session.GetLastError(); err != nil || m.ID != 1<<53+1 || m.List[0] != math.MaxUint64 {
+				t.Errorf("nested GetInto: got %+v, %v", m, err)
+			}
+		})
+	}
+
+	// entries written before type tags keep decoding numbers as float64
+	st := mapstore.NewMapSessionStore()
+	st.AddEntry("legacy", &store.SessionEntry{Data: []byte(`{"sessionValues":{"Values":{"n":3,"m":{"x":1}}}}`), SessionExpiry: time.Now().Add(time.Minute)})
+	vals, _, err := FindSessionValuesByKey("legacy", st)
+	if err != nil || vals["n"] != float64(3) || vals["m"].(map[string]interface{})["x"] != float64(1) {
+		t.Fatalf("expected legacy numbers as float64, got %v %v", vals, err)
+	}
+}
+
+type testCart struct {
+	Items []string
+	Total int64
+}
+
+type testProfile struct {
+	Name string
+}
+
+type testAccount struct {
+	ID int64
+}
+
+func init() {
+	RegisterType(testCart{})
+}
+
+func TestSessionTypedValues(t *testing.T) {
+	for name, codec := range map[string]CodecID{"Gob": GobCodec, "JSON": JSONCodec, "JSONObject": JSONObjectCodec} {
+		t.Run(name, func(t *testing.T) {
+			st := mapstore.NewMapSessionStore()
+			ctx := context.Background()
+			session, tok, _ := OpenSessionWithOptions(ctx, token.EmptyToken, st, Options{Codec: codec})
+			session.SetVar("cart", testCart{Items: []string{"a", "b"}, Total: 1<<53 + 1})
+			session.Save(time.Minute)
+
+			session, _, _ = OpenSessionWithOptions(ctx, tok, st, Options{Codec: codec})
+			if cart, ok := session.Var("cart").(testCart); !ok || cart.Total != 1<<53+1 || len(cart.Items) != 2 {
+				t.Fatalf("expected registered type to be restored, got %#v", session.Var("cart"))
+			}
+			var cart testCart
+			session.GetInto("cart", &cart)
+			if err := session.GetLastError(); err != nil || cart.Items[1] != "b" {
+				t.Fatalf("GetInto: got %#v, %v", cart, err)
+			}
+
+			var missing testCart
+			session.GetInto("missing", &missing)
+			if session.GetLastError() == nil {
+				t.Fatal("expected error for missing value")
+			}
+		})
+	}
+
+	st := mapstore.NewMapSessionStore()
+	session, tok, _ := OpenSession(token.EmptyToken, st)
+	session.SetVar("profile", testProfile{Name: "bob"})
+	session.Save(time.Minute)
+	session, _, _ = OpenSession(tok, st)
+	var profile testProfile
+	session.GetInto("profile", &profile)
+	if err := session.GetLastError(); err != nil || profile.Name != "bob" {
+		t.Fatalf("expected unregistered struct to be converted, got %#v, %v", profile, err)
+	}
+
+	session.SetVar("account", testAccount{ID: 1<<53 + 1})
+	session.Save(time.Minute)
+	session, _, _ = OpenSession(tok, st)
+	var account testAccount
+	session.GetInto("account", &account)
+	if err := session.GetLastError(); err != nil || account.ID != 1<<53+1 {
+		t.Fatalf("expected unregistered struct to keep its int64, got %d, %v", account.ID, err)
+	}
+	session.SetVar("account", map[string]interface{}{"ID": float64(1 << 53)})
+	session.GetInto("account", &account)
+	if account.ID != 1<<53 {
+		t.Fatalf("expected GetInto to use the value set after loading, got %d", account.ID)
+	}
+}
+
+func TestSessionGenerics(t *testing.T) {
+	st := mapstore.NewMapSessionStore()
+	session, tok, _ := OpenSession(token.EmptyToken, st)
+	Set(session, "id", uint64(math.MaxUint64))
+	Set(session, "name", "bob")
+	cartKey := Key[testCart]("cart")
+	cartKey.Set(session, testCart{Items: []string{"a"}})
+	Set(session, "profile", testProfile{Name: "alice"})
+	Set(session, "account", testAccount{ID: 1<<53 + 1})
+	Set(session, "ids", []interface{}{int64(1<<53 + 1)})
+	session.Save(time.Minute)
+
+	session, _, _ = OpenSession(tok, st)
+	if id, err := Get[uint64](session, "id"); err != nil || id != math.MaxUint64 {
+		t.Fatalf("id: got %d, %v", id, err)
+	}
+	if name, err := Get[string](session, "name"); err != nil || name != "bob" {
+		t.Fatalf("name: got %q, %v", name, err)
+	}
+	if cart, err := cartKey.Get(session); err != nil || cart.Items[0] != "a" {
+		t.Fatalf("cart: got %#v, %v", cart, err)
+	}
+	if profile, err := Get[testProfile](session, "profile"); err != nil || profile.Name != "alice" {
+		t.Fatalf("profile: got %#v, %v", profile, err)
+	}
+	if account, err := Get[testAccount](session, "account"); err != nil || account.ID != 1<<53+1 {
+		t.Fatalf("account: got %d, %v", account.ID, err)
+	}
+	if ids, err := Get[[]int64](session, "ids"); err != nil || ids[0] != 1<<53+1 {
+		t.Fatalf("ids: got %v, %v", ids, err)
+	}
+
+	if _, err := Get[int](session, "id"); err == nil {
+		t.Fatal("expected error for uint64 that overflows int")
+	}
+	if _, err := Get[int](session, "name"); err == nil {
+		t.Fatal("expected error for type mismatch")
+	}
+	if _, err := Get[string](session, "missing"); err == nil {
+		t.Fatal("expected error for missing value")
+	}
+	if session.GetLastError() != nil {
+		t.Fatal("expected typed accessors not to set the last error")
+	}
+}
+
+type failingStore struct {
+	store.SessionEntryStore
+}
+
+var errTestStore = errors.New("store down")
+
+func (f failingStore) AddEntry(key string, entry *store.SessionEntry) error {
+	return errTestStore
+}
+
+// timeoutStore fails writes with a wrapped context error, as a network
+// store does when its request times out.
+type timeoutStore struct {
+	store.SessionEntryStore
+}
+
+func (f timeoutStore) AddEntry(key string, entry *store.SessionEntry) error {
+	return fmt.Errorf("store request: %w", context.DeadlineExceeded)
+}
+
+func TestSessionErrors(t *testing.T) {
+	st := mapstore.NewMapSessionStore()
+	session, tok, _ := OpenSession(token.EmptyToken, st)
+	session.SetVar("n", 1)
+	if err := session.Save(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	session, _, _ = OpenSession(tok, st)
+	session.StringVar("n")
+	session.Key()
+	if err := session.GetLastError(); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch to be kept, got %v", err)
+	}
+	session.IntVar("missing")
+	if err := session.GetLastError(); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if v, ok, err := session.Lookup("n"); !ok || err != nil || v != 1 {
+		t.Fatalf("Lookup: got %v %v %v", v, ok, err)
+	}
+	if _, ok, err := session.Lookup("missing"); ok || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound from Lookup, got %v", err)
+	}
+	if _, err := Get[string](session, "n"); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch from Get, got %v", err)
+	}
+
+	session, _, _ = OpenSession(token.EmptyToken, failingStore{st})
+	err := session.Save(time.Minute)
+	if !errors.Is(err, ErrStore) || !errors.Is(err, errTestStore) {
+		t.Fatalf("expected wrapped store error, got %v", err)
+	}
+	if session.GetLastError() != err {
+		t.Fatal("expected Save error to be recorded as the last error")
+	}
+
+	authSession, tok, _, _ := OpenSessionWithAuth(token.EmptyToken, token.EmptyToken, time.Minute, st)
+	authSession.Save(time.Minute)
+	_, _, _, err = OpenSessionWithAuth(tok, token.TokenStr("wrong"), time.Minute, st)
+	if !errors.Is(err, ErrInvalidAuthToken) {
+		t.Fatalf("expected ErrInvalidAuthToken, got %v", err)
+	}
+}
+
+func TestSessionPolicy(t *testing.T) {
+	st := mapstore.NewMapSessionStore()
+	ctx := context.Background()
+	policy := Options{Policy: Policy{IdleTimeout: time.Minute, MaxLifetime: time.Hour}}
+	session, tok, _ := OpenSessionWithOptions(ctx, token.EmptyToken, st, policy)
+	session.SetVar("a", "b")
+	session.Save(time.Hour * 24)
+	entry, _, _ := st.FindEntry(tok.String())
+	if entry.SessionExpiry.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("expected expiry to be capped by the idle timeout, got %v", entry.SessionExpiry)
+	}
+
+	session, tok2, _ := OpenSessionWithOptions(ctx, tok, st, policy)
+	if tok2.String() != tok.String() || session.StringVar("a") != "b" {
+		t.Fatal("expected session within policy to be loaded")
+	}
+	session.Clear()
+	session.Save(time.Hour)
+
+	// the session is older than the lifetime allowed by a stricter policy
+	time.Sleep(time.Millisecond)
+	strict := Options{Policy: Policy{MaxLifetime: time.Millisecond}}
+	session, tok2, _ = OpenSessionWithOptions(ctx, tok, st, strict)
+	if tok2.String() == tok.String() {
+		t.Fatal("expected session past its lifetime to be replaced")
+	}
+	session.Save(time.Hour)
+	entry, _, _ = st.FindEntry(tok2.String())
+	if entry.SessionExpiry.After(time.Now().Add(time.Millisecond)) {
+		t.Fatalf("expected expiry to be capped by the lifetime, got %v", entry.SessionExpiry)
+	}
+
+	st.AddEntry("legacy", &store.SessionEntry{Data: []byte(`{"sessionValues":{"Values":{}}}`), SessionExpiry: time.Now().Add(time.Minute)})
+	if _, tok2, _ = OpenSessionWithOptions(ctx, token.TokenStr("legacy"), st, policy); tok2.String() == "legacy" {
+		t.Fatal("expected session without creation time to be replaced when MaxLifetime is set")
+	}
+	if _, tok2, _ = OpenSessionWithOptions(ctx, token.TokenStr("legacy"), st, Options{}); tok2.String() != "legacy" {
+		t.Fatal("expected session without creation time to be loaded without a policy")
+	}
+
+	// cookies expire with the store entry
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://blah/", nil)
+	cookieSession, _ := OpenCookieSessionWithOptions(ctx, "web", st, recorder, request, sessioncookie.DefaultCookieOptions, policy)
+	cookieSession.SetVar("a", "b")
+	cookieSession.Save(time.Hour * 24)
+	for _, c := range recorder.Result().Cookies() {
+		if c.MaxAge != 60 {
+			t.Fatalf("expected cookie MaxAge capped by the idle timeout, got %d", c.MaxAge)
+		}
+	}
+}
+
+func TestCookieOptions(t *testing.T) {
+	st := mapstore.NewMapSessionStore()
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://blah/", nil)
+	request.Header.Set("X-Forwarded-Proto", "https")
+	session, err := OpenCookieSession("web", st, recorder, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Save(time.Minute)
+	for _, c := range recorder.Result().Cookies() {
+		if !c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteLaxMode || c.Path != "/" || c.Domain != "" {
+			t.Fatalf("unexpected default cookie attributes: %v", c)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "http://blah/", nil)
+	session, _ = OpenCookieSession("web", st, recorder, request)
+	session.Save(time.Minute)
+	if c := recorder.Result().Cookies()[0]; c.Secure {
+		t.Fatal("expected plain http request not to get a secure cookie")
+	}
+
+	recorder = httptest.NewRecorder()
+	cookieOpts := sessioncookie.CookieOptions{
+		Path:        "/app",
+		Domain:      "example.com",
+		Secure:      sessioncookie.SecureAlways,
+		SameSite:    http.SameSiteStrictMode,
+		Partitioned: true,
+	}
+	session, _ = OpenCookieSessionWithOptions(context.Background(), "web", st, recorder, request, cookieOpts, Options{})
+	session.Save(time.Minute)
+	session.RemoveCookie()
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 4 {
+		t.Fatalf("expected 4 cookies, got %d", len(cookies))
+	}
+	for _, c := range cookies {
+		if !c.Secure || c.HttpOnly || c.SameSite != http.SameSiteStrictMode || c.Path != "/app" || c.Domain != "example.com" || !c.Partitioned {
+			t.Fatalf("unexpected cookie attributes: %v", c)
+		}
+	}
+}
+
+func TestCookiePrefix(t *testing.T) {
+	st := mapstore.NewMapSessionStore()
+	ctx := context.Background()
+
+	// session from before the prefix was turned on
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://blah/", nil)
+	session, _ := OpenCookieSession("web", st, recorder, request)
+	session.SetVar("a", "b")
+	session.Save(time.Minute)
+
+	request, _ = http.NewRequest("GET", "http://blah/", nil)
+	for _, c := range recorder.Result().Cookies() {
+		request.AddCookie(c)
+	}
+	recorder = httptest.NewRecorder()
+	host := sessioncookie.DefaultCookieOptions
+	host.Prefix = sessioncookie.PrefixHost
+	session, err := OpenCookieSessionWithOptions(ctx, "web", st, recorder, request, host, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.StringVar("a") != "b" {
+		t.Fatal("expected legacy cookie to be read")
+	}
+	session.Save(time.Minute)
+	for _, c := range recorder.Result().Cookies() {
+		if !strings.HasPrefix(c.Name, "__Host-web_") {
+			if c.MaxAge >= 0 {
+				t.Fatalf("expected legacy cookie to be expired: %v", c)
+			}
+			continue
+		}
+		if !c.Secure || c.Path != "/" || c.Domain != "" {
+			t.Fatalf("unexpected prefixed cookie: %v", c)
+		}
+	}
+
+	for _, bad := range []sessioncookie.CookieOptions{
+		{Prefix: sessioncookie.PrefixHost, Path: "/app"},
+		{Prefix: sessioncookie.PrefixHost, Path: "/", Domain: "example.com"},
+		{Prefix: sessioncookie.PrefixHost, Path: "/", Secure: sessioncookie.SecureNever},
+		{Prefix: sessioncookie.PrefixSecure, Secure: sessioncookie.SecureNever},
+		{Prefix: "__Other-"},
+		{Path: "/", SameSite: http.SameSiteNoneMode},
+		{Path: "/", SameSite: http.SameSiteNoneMode, Secure: sessioncookie.SecureNever},
+		{Path: "/", Partitioned: true},
+		{Prefix: sessioncookie.PrefixHost, Path: "/", Partitioned: true},
+	} {
+		if _, err = OpenCookieSessionWithOptions(ctx, "web", st, recorder, request, bad, Options{}); err == nil {
+			t.Fatalf("expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestCookiePrefixLogout(t *testing.T) {
+	st := mapstore.NewMapSessionStore()
+	ctx := context.Background()
+	host := sessioncookie.DefaultCookieOptions
+	host.Prefix = sessioncookie.PrefixHost
+	jar, _ := cookiejar.New(nil)
+	u, _ := url.Parse("https://example.com/")
+	open := func(opts sessioncookie.CookieOptions) (*CookieSession, *httptest.ResponseRecorder) {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", u.String(), nil)
+		for _, c := range jar.Cookies(u) {
+			request.AddCookie(c)
+		}
+		session, err := OpenCookieSessionWithOptions(ctx, "web", st, recorder, request, opts, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session, recorder
+	}
+
+	session, recorder := open(sessioncookie.DefaultCookieOptions)
+	session.SetVar("user", "alice")
+	session.Save(time.Minute)
+	jar.SetCookies(u, recorder.Result().Cookies())
+	legacy := jar.Cookies(u)
+
+	// the first request with the prefix turned on moves the session over
+	session, recorder = open(host)
+	if session.StringVar("user") != "alice" {
+		t.Fatal("expected legacy cookie to be read")
+	}
+	session.Save(time.Minute)
+	jar.SetCookies(u, recorder.Result().Cookies())
+	for _, c := range jar.Cookies(u) {
+		if !strings.HasPrefix(c.Name, "__Host-") {
+			t.Fatalf("expected legacy cookie %s to be expired", c.Name)
+		}
+	}
+
+	session, recorder = open(host)
+	session.RemoveCookie()
+	jar.SetCookies(u, recorder.Result().Cookies())
+	if cookies := jar.Cookies(u); len(cookies) != 0 {
+		t.Fatalf("expected logout to remove all cookies, got %v", cookies)
+	}
+	if session, _ = open(host); session.StringVar("user") == "alice" {
+		t.Fatal("expected a new session after logout")
+	}
+
+	// a client still holding the legacy cookies is ignored once they're
+	// turned off
+	jar, _ = cookiejar.New(nil)
+	jar.SetCookies(u, legacy)
+	host.IgnoreUnprefixed = true
+	if session, _ = open(host); session.StringVar("user") == "alice" {
+		t.Fatal("expected legacy cookies to be ignored")
+	}
+}
+
+type findCountingStore struct {
+	*mapstore.MapSessionStore
+	finds int
+}
+
+func (f *findCountingStore) FindEntry(key string) (*store.SessionEntry, bool, error) {
+	f.finds++
+	return f.MapSessionStore.FindEntry(key)
+}
+
+func TestSignedTokens(t *testing.T) {
+	st := &findCountingStore{MapSessionStore: mapstore.NewMapSessionStore()}
+	ctx := context.Background()
+	signer, _ := signed.NewSigner([]byte(strings.Repeat("k", 32)))
+	opts := Options{Signer: signer}
+
+	session, tok, _ := OpenSessionWithOptions(ctx, token.EmptyToken, st, opts)
+	if tok.String() == session.Key() {
+		t.Fatal("expected returned token to be signed")
+	}
+	session.SetVar("a", "b")
+	session.Save(time.Minute)
+
+	session, tok2, _ := OpenSessionWithOptions(ctx, tok, st, opts)
+	if !tok2.Equal(tok) || session.StringVar("a") != "b" {
+		t.Fatal("expected signed token to load the session")
+	}
+
+	st.finds = 0
+	for _, forged := range []token.Token{token.TokenStr(session.Key()), token.TokenStr(session.Key() + ".AAAA"), token.TokenStr("garbage")} {
+		_, tok2, _ = OpenSessionWithOptions(ctx, forged, st, opts)
+		if tok2.Equal(tok) {
+			t.Fatalf("expected %q to start a new session", forged)
+		}
+	}
+	if st.finds != 0 {
+		t.Fatalf("expected forged tokens not to reach the store, got %d lookups", st.finds)
+	}
+
+	authSession, tok, authTok, _ := OpenSessionWithAuthOptions(ctx, token.EmptyToken, token.EmptyToken, time.Minute, st, opts)
+	authSession.Save(time.Minute)
+	if _, tok2, _, err := OpenSessionWithAuthOptions(ctx, tok, authTok, time.Minute, st, opts); err != nil || !tok2.Equal(tok) {
+		t.Fatalf("expected signed auth session to load, got %v", err)
+	}
+	if tok2 := authSession.Recreate(); tok2.String() == authSession.Key() {
+		t.Fatal("expected Recreate to return a signed token")
+	}
+}
+
+func TestHeaderSession(t *testing.T) {
+	st := mapstore.NewMapSessionStore()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://blah/", nil)
+	session, err := OpenHeaderSession(st, recorder, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.SetVar("a", "b")
+	session.Save(time.Minute)
+	tok, authTok := recorder.Header().Get("X-Session-Token"), recorder.Header().Get("X-Session-Auth")
+	if tok == "" || authTok == "" {
+		t.Fatalf("expected tokens in response headers, got %v", recorder.Header())
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "http://blah/", nil)
+	request.Header.Set("Authorization", "Bearer "+tok)
+	request.Header.Set("X-Session-Auth", authTok)
+	session, err = OpenHeaderSession(st, recorder, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.StringVar("a") != "b" {
+		t.Fatal("expected session to be loaded from headers")
+	}
+	session.Save(time.Minute)
+	if recorder.Header().Get("X-Session-Token") != tok {
+		t.Fatal("expected same session token to be returned")
+	}
+
+	// the auth token is sent in a configured header pair
+	headers := headertoken.Headers{Session: "X-Sid", AuthRequest: "X-Auth-Request", AuthResponse: "X-Auth-Response"}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "http://blah/", nil)
+	request.Header.Set("Authorization", "Bearer "+tok)
+	request.Header.Set("X-Auth-Request", authTok)
+	session, err = OpenHeaderSessionWithOptions(context.Background(), st, recorder, request, headers, Options{})
+	if err != nil || session.StringVar("a") != "b" {
+		t.Fatalf("expected session to be loaded from configured headers, got %v", err)
+	}
+	session.Save(time.Minute)
+	if recorder.Header().Get("X-Sid") != tok || recorder.Header().Get("X-Auth-Response") == "" {
+		t.Fatalf("expected tokens in configured response headers, got %v", recorder.Header())
+	}
+	session.RemoveTokens()
+	if v, ok := recorder.Header()["X-Sid"]; !ok || v[0] != "" {
+		t.Fatal("expected RemoveTokens to send empty headers")
+	}
+
+	for _, bad := range []headertoken.Headers{
+		{},
+		{Session: "X-Sid", AuthRequest: "X-Auth"},
+		{AuthRequest: "X-Auth", AuthResponse: "X-Auth"},
+	} {
+		if _, err = OpenHeaderSessionWithOptions(context.Background(), st, recorder, request, bad, Options{}); err == nil {
+			t.Fatalf("expected %+v to be rejected", bad)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "http://blah/", nil)
+	request.Header.Set("Authorization", "Basic "+tok)
+	session, _ = OpenHeaderSession(st, recorder, request)
+	if session.Key() == tok {
+		t.Fatal("expected other authorization schemes to be ignored")
+	}
+}
+
+var (
+	_ TokenTransport = (*sessioncookie.SessionCookie)(nil)
+	_ TokenTransport = (*sessioncookie.Cookie)(nil)
+	_ TokenTransport = (*headertoken.HeaderToken)(nil)
+)
+
+// queryTransport reads a token from a query parameter and remembers the token
+// to send back.
+type queryTransport struct {
+	name string
+	req  *http.Request
+	sent token.Token
+}
+
+func (q *queryTransport) GetToken() token.Token {
+	if v := q.req.URL.Query().Get(q.name); v != "" {
+		return token.TokenStr(v)
+	}
+	return token.EmptyToken
+}
+
+func (q *queryTransport) SetToken(t token.Token, d time.Duration) {
+	q.sent = t
+}
+
+func (q *queryTransport) Remove() {
+	q.sent = token.EmptyToken
+}
+
+func TestTransportSession(t *testing.T) {
+	st := mapstore.NewMapSessionStore()
+	request, _ := http.NewRequest("GET", "http://blah/", nil)
+	tr, authTr := &queryTransport{name: "s", req: request}, &queryTransport{name: "a", req: request}
+	session, err := OpenTransportSession(tr, authTr, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.SetVar("a", "b")
+	session.Save(time.Minute)
+	if tr.sent == nil || authTr.sent == nil {
+		t.Fatal("expected Save to send both tokens")
+	}
+
+	request, _ = http.NewRequest("GET", "http://blah/?s="+tr.sent.String()+"&a="+authTr.sent.String(), nil)
+	tr, authTr = &queryTransport{name: "s", req: request}, &queryTransport{name: "a", req: request}
+	session, err = OpenTransportSession(tr, authTr, st)
+	if err != nil || session.StringVar("a") != "b" {
+		t.Fatalf("expected session to be loaded through the transports, got %v", err)
+	}
+	old := session.Key()
+	session.New()
+	session.Save(time.Minute)
+	if tr.sent.String() == old || session.StringVar("a") != "" {
+		t.Fatal("expected New to start a new session")
+	}
+	if _, ok, _ := st.FindEntry(old); ok {
+		t.Fatal("expected New to delete the old session")
+	}
+	session.RemoveTokens()
+	if !tr.sent.IsEmpty() || !authTr.sent.IsEmpty() {
+		t.Fatal("expected RemoveTokens to remove both tokens")
+	}
+}
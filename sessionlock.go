@@ -0,0 +1,75 @@
+package httpsession
+
+import (
+	"context"
+	"errors"
+	"github.com/timob/httpsession/store"
+	"github.com/timob/httpsession/token"
+	"github.com/timob/httpsession/token/sessioncookie"
+	"net/http"
+	"time"
+)
+
+var ErrLockTimeout = errors.New("timed out waiting for session lock")
+
+// DefaultLockLease is used when SessionLock.Lease is zero.
+var DefaultLockLease = time.Second * 30
+
+// SessionLock opens sessions holding a lock on the session key, so that
+// requests for one session are handled one at a time. The store must
+// implement store.Locker. Save, Touch and Close release the lock.
+type SessionLock struct {
+	// Timeout is how long to wait for the lock. Zero waits until the context
+	// is done.
+	Timeout time.Duration
+	// Lease is how long the lock is held if it is never released, for
+	// example because the process holding it crashed.
+	Lease time.Duration
+}
+
+func (l SessionLock) OpenSession(ctx context.Context, idToken token.Token, store store.SessionEntryStore) (*Session, token.Token, error) {
+	return OpenSessionWithOptions(ctx, idToken, store, Options{Lock: &l})
+}
+
+func (l SessionLock) OpenSessionWithAuth(ctx context.Context, idToken token.Token, authToken token.Token, authTokenTimeout time.Duration, store store.SessionEntryStore) (*AuthSession, token.Token, token.Token, error) {
+	return OpenSessionWithAuthOptions(ctx, idToken, authToken, authTokenTimeout, store, Options{Lock: &l})
+}
+
+// OpenCookieSession opens a cookie session using DeaultAuthTimeout.
+func (l SessionLock) OpenCookieSession(ctx context.Context, name string, store store.SessionEntryStore, w http.ResponseWriter, r *http.Request) (*CookieSession, error) {
+	return DeaultAuthTimeout.OpenCookieSessionWithOptions(ctx, name, store, w, r, sessioncookie.DefaultCookieOptions, Options{Lock: &l})
+}
+
+func (l *SessionLock) lease() time.Duration {
+	if l.Lease <= 0 {
+		return DefaultLockLease
+	}
+	return l.Lease
+}
+
+// loadOrNewSession loads the session, or creates a new one if there isn't a
+// valid one for its key. If lock is set the key is locked first, and unlocked
+// again on error.
+func loadOrNewSession(s session, lock *SessionLock) (err error) {
+	if lock != nil {
+		if err = s.LockSession(lock.Timeout, lock.lease()); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				s.UnlockSession()
+			}
+		}()
+	}
+
+	ok, err := s.LoadSession()
+	if err != nil || ok {
+		return
+	}
+	if lock != nil {
+		if err = s.UnlockSession(); err != nil {
+			return
+		}
+	}
+	return s.NewSession()
+}
@@ -0,0 +1,212 @@
+// Package compressstore wraps a store.SessionEntryStore so that large entries
+// are compressed before they reach the backing store.
+package compressstore
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"fmt"
+	. "github.com/timob/httpsession/store"
+	"io"
+	"time"
+)
+
+type Method int
+
+const (
+	Flate Method = iota
+	Gzip
+)
+
+// Header bytes written in front of entry data. They can't start JSON or gob
+// encoded data, and httpsession.RegisterCodec reserves them as codec ids, so
+// entries written before compression was enabled are read back unchanged.
+const (
+	headerRaw   byte = 0xc0
+	headerFlate byte = 0xc1
+	headerGzip  byte = 0xc2
+)
+
+type Options struct {
+	// Threshold is the data size below which entries are not compressed.
+	// Defaults to 1024.
+	Threshold int
+	Method    Method
+	// Level is the compression level, see compress/flate. Zero means
+	// flate.DefaultCompression.
+	Level int
+	// Stats, if set, is called after each compressed write with the
+	// original and stored data sizes.
+	Stats func(original, stored int)
+}
+
+type CompressSessionStore struct {
+	SessionEntryStore
+	ctxStore ContextSessionEntryStore
+	opts     Options
+}
+
+func NewCompressSessionStore(s SessionEntryStore, opts Options) (*CompressSessionStore, error) {
+	if opts.Threshold <= 0 {
+		opts.Threshold = 1024
+	}
+	if opts.Level == 0 {
+		opts.Level = flate.DefaultCompression
+	}
+	if opts.Level < flate.HuffmanOnly || opts.Level > flate.BestCompression {
+		return nil, fmt.Errorf("compressstore: invalid compression level %d", opts.Level)
+	}
+	if opts.Method != Flate && opts.Method != Gzip {
+		return nil, fmt.Errorf("compressstore: unknown method %d", opts.Method)
+	}
+	return &CompressSessionStore{s, WithContext(s), opts}, nil
+}
+
+func (c *CompressSessionStore) FindEntry(key string) (*SessionEntry, bool, error) {
+	return c.FindEntryContext(context.Background(), key)
+}
+
+func (c *CompressSessionStore) FindEntryContext(ctx context.Context, key string) (*SessionEntry, bool, error) {
+	entry, ok, err := c.ctxStore.FindEntryContext(ctx, key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	data, err := decompress(entry.Data)
+	if err != nil {
+		return nil, false, err
+	}
+	return &SessionEntry{Data: data, SessionExpiry: entry.SessionExpiry, Version: entry.Version}, true, nil
+}
+
+func (c *CompressSessionStore) AddEntry(key string, entry *SessionEntry) error {
+	return c.AddEntryContext(context.Background(), key, entry)
+}
+
+func (c *CompressSessionStore) AddEntryContext(ctx context.Context, key string, entry *SessionEntry) error {
+	data, err := c.compress(entry.Data)
+	if err != nil {
+		return err
+	}
+	stored := &SessionEntry{Data: data, SessionExpiry: entry.SessionExpiry}
+	if err := c.ctxStore.AddEntryContext(ctx, key, stored); err != nil {
+		return err
+	}
+	entry.Version = stored.Version
+	return nil
+}
+
+// CompareAndSwapEntry returns ErrNotSupported if the backing store is not a
+// CASStore.
+func (c *CompressSessionStore) CompareAndSwapEntry(key string, version uint64, entry *SessionEntry) (bool, error) {
+	cas, ok := c.SessionEntryStore.(CASStore)
+	if !ok {
+		return false, ErrNotSupported
+	}
+	data, err := c.compress(entry.Data)
+	if err != nil {
+		return false, err
+	}
+	stored := &SessionEntry{Data: data, SessionExpiry: entry.SessionExpiry}
+	ok, err = cas.CompareAndSwapEntry(key, version, stored)
+	if ok {
+		entry.Version = stored.Version
+	}
+	return ok, err
+}
+
+// LockEntry returns ErrNotSupported if the backing store is not a Locker.
+func (c *CompressSessionStore) LockEntry(ctx context.Context, key string, lease time.Duration) (string, error) {
+	locker, ok := c.SessionEntryStore.(Locker)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	return locker.LockEntry(ctx, key, lease)
+}
+
+func (c *CompressSessionStore) UnlockEntry(key string, lockToken string) error {
+	locker, ok := c.SessionEntryStore.(Locker)
+	if !ok {
+		return ErrNotSupported
+	}
+	return locker.UnlockEntry(key, lockToken)
+}
+
+func (c *CompressSessionStore) DeleteEntry(key string) error {
+	return Delete(c.SessionEntryStore, key)
+}
+
+func (c *CompressSessionStore) TouchEntry(key string, expiry time.Time) (bool, error) {
+	return Touch(c.SessionEntryStore, key, expiry)
+}
+
+// IterateEntries skips entries that can't be decompressed.
+func (c *CompressSessionStore) IterateEntries(fn func(key string, entry *SessionEntry) bool) error {
+	return Iterate(c.SessionEntryStore, func(key string, entry *SessionEntry) bool {
+		data, err := decompress(entry.Data)
+		if err != nil {
+			return true
+		}
+		return fn(key, &SessionEntry{Data: data, SessionExpiry: entry.SessionExpiry, Version: entry.Version})
+	})
+}
+
+func (c *CompressSessionStore) compress(data []byte) ([]byte, error) {
+	raw := append([]byte{headerRaw}, data...)
+	if len(data) < c.opts.Threshold {
+		return raw, nil
+	}
+
+	buf := new(bytes.Buffer)
+	var w io.WriteCloser
+	var err error
+	if c.opts.Method == Gzip {
+		buf.WriteByte(headerGzip)
+		w, err = gzip.NewWriterLevel(buf, c.opts.Level)
+	} else {
+		buf.WriteByte(headerFlate)
+		w, err = flate.NewWriter(buf, c.opts.Level)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	stored := buf.Bytes()
+	if len(stored) >= len(raw) {
+		stored = raw
+	}
+	if c.opts.Stats != nil {
+		c.opts.Stats(len(data), len(stored))
+	}
+	return stored, nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	var r io.ReadCloser
+	var err error
+	switch data[0] {
+	case headerRaw:
+		return data[1:], nil
+	case headerFlate:
+		r = flate.NewReader(bytes.NewReader(data[1:]))
+	case headerGzip:
+		r, err = gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return data, nil
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,71 @@
+package compressstore
+
+import (
+	"bytes"
+	. "github.com/timob/httpsession/store"
+	"github.com/timob/httpsession/store/mapstore"
+	"github.com/timob/httpsession/store/storetest"
+	"testing"
+	"time"
+)
+
+func TestConformance(t *testing.T) {
+	for name, method := range map[string]Method{"Flate": Flate, "Gzip": Gzip} {
+		t.Run(name, func(t *testing.T) {
+			storetest.RunConformance(t, func(t testing.TB) SessionEntryStore {
+				c, err := NewCompressSessionStore(mapstore.NewMapSessionStore(), Options{Threshold: 4, Method: method})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return c
+			})
+		})
+	}
+}
+
+func TestCompressStore(t *testing.T) {
+	backing := mapstore.NewMapSessionStore()
+	var original, stored int
+	c, err := NewCompressSessionStore(backing, Options{Threshold: 100, Stats: func(o, s int) {
+		original, stored = o, s
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(time.Minute)
+
+	large := bytes.Repeat([]byte(`{"item":"widget","qty":1},`), 100)
+	c.AddEntry("large", &SessionEntry{Data: large, SessionExpiry: expiry})
+	raw, _, _ := backing.FindEntry("large")
+	if raw.Data[0] != headerFlate || len(raw.Data) >= len(large) {
+		t.Fatalf("expected large entry to be compressed, stored %d of %d bytes", len(raw.Data), len(large))
+	}
+	if original != len(large) || stored != len(raw.Data) {
+		t.Fatalf("stats reported %d -> %d", original, stored)
+	}
+
+	c.AddEntry("small", &SessionEntry{Data: []byte(`{"a":1}`), SessionExpiry: expiry})
+	raw, _, _ = backing.FindEntry("small")
+	if raw.Data[0] != headerRaw {
+		t.Fatal("expected small entry to be stored uncompressed")
+	}
+
+	legacy := []byte(`{"Values":{"a":1}}`)
+	backing.AddEntry("legacy", &SessionEntry{Data: legacy, SessionExpiry: expiry})
+	for key, want := range map[string][]byte{"large": large, "small": []byte(`{"a":1}`), "legacy": legacy} {
+		entry, ok, err := c.FindEntry(key)
+		if err != nil || !ok || !bytes.Equal(entry.Data, want) {
+			t.Fatalf("entry %s: got %v ok %v err %v", key, entry, ok, err)
+		}
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	storetest.RunForwarding(t, func(t testing.TB, inner SessionEntryStore) SessionEntryStore {
+		c, err := NewCompressSessionStore(inner, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	})
+}
@@ -0,0 +1,179 @@
+// Package encryptstore wraps a store.SessionEntryStore so that entry data is
+// encrypted with AES-GCM before it reaches the backing store.
+package encryptstore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	. "github.com/timob/httpsession/store"
+	"io"
+	"time"
+)
+
+// ErrDecrypt is returned when an entry fails authentication, because it was
+// modified or stored under a different session key.
+var ErrDecrypt = errors.New("encryptstore: entry failed to decrypt")
+
+// Key is an AES key of 16, 24 or 32 bytes. ID is stored in front of every
+// entry sealed with the key, so that entries remain readable after the current
+// key is rotated.
+type Key struct {
+	ID     byte
+	Secret []byte
+}
+
+// EncryptSessionStore seals entry data as
+//
+//	key id (1 byte) | nonce (12 bytes) | AES-GCM ciphertext and tag
+//
+// using the session key as associated data, so an entry copied to another
+// session key does not decrypt.
+type EncryptSessionStore struct {
+	SessionEntryStore
+	ctxStore ContextSessionEntryStore
+	current  byte
+	aeads    map[byte]cipher.AEAD
+}
+
+// NewEncryptSessionStore seals new entries with current. Entries sealed with
+// any of old can still be read. Entries with an unknown key id are reported as
+// missing, so retiring a key ends the sessions that use it.
+func NewEncryptSessionStore(s SessionEntryStore, current Key, old ...Key) (*EncryptSessionStore, error) {
+	e := &EncryptSessionStore{SessionEntryStore: s, ctxStore: WithContext(s), current: current.ID, aeads: make(map[byte]cipher.AEAD)}
+	for _, k := range append([]Key{current}, old...) {
+		if _, ok := e.aeads[k.ID]; ok {
+			return nil, fmt.Errorf("encryptstore: duplicate key id %d", k.ID)
+		}
+		block, err := aes.NewCipher(k.Secret)
+		if err != nil {
+			return nil, err
+		}
+		e.aeads[k.ID], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (e *EncryptSessionStore) FindEntry(key string) (*SessionEntry, bool, error) {
+	return e.FindEntryContext(context.Background(), key)
+}
+
+func (e *EncryptSessionStore) FindEntryContext(ctx context.Context, key string) (*SessionEntry, bool, error) {
+	entry, ok, err := e.ctxStore.FindEntryContext(ctx, key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	data, ok, err := e.open(key, entry.Data)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return &SessionEntry{Data: data, SessionExpiry: entry.SessionExpiry, Version: entry.Version}, true, nil
+}
+
+func (e *EncryptSessionStore) AddEntry(key string, entry *SessionEntry) error {
+	return e.AddEntryContext(context.Background(), key, entry)
+}
+
+func (e *EncryptSessionStore) AddEntryContext(ctx context.Context, key string, entry *SessionEntry) error {
+	sealed, err := e.seal(key, entry.Data)
+	if err != nil {
+		return err
+	}
+	stored := &SessionEntry{Data: sealed, SessionExpiry: entry.SessionExpiry}
+	if err := e.ctxStore.AddEntryContext(ctx, key, stored); err != nil {
+		return err
+	}
+	entry.Version = stored.Version
+	return nil
+}
+
+// CompareAndSwapEntry returns ErrNotSupported if the backing store is not a
+// CASStore.
+func (e *EncryptSessionStore) CompareAndSwapEntry(key string, version uint64, entry *SessionEntry) (bool, error) {
+	cas, ok := e.SessionEntryStore.(CASStore)
+	if !ok {
+		return false, ErrNotSupported
+	}
+	sealed, err := e.seal(key, entry.Data)
+	if err != nil {
+		return false, err
+	}
+	stored := &SessionEntry{Data: sealed, SessionExpiry: entry.SessionExpiry}
+	ok, err = cas.CompareAndSwapEntry(key, version, stored)
+	if ok {
+		entry.Version = stored.Version
+	}
+	return ok, err
+}
+
+// LockEntry returns ErrNotSupported if the backing store is not a Locker.
+func (e *EncryptSessionStore) LockEntry(ctx context.Context, key string, lease time.Duration) (string, error) {
+	locker, ok := e.SessionEntryStore.(Locker)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	return locker.LockEntry(ctx, key, lease)
+}
+
+func (e *EncryptSessionStore) UnlockEntry(key string, lockToken string) error {
+	locker, ok := e.SessionEntryStore.(Locker)
+	if !ok {
+		return ErrNotSupported
+	}
+	return locker.UnlockEntry(key, lockToken)
+}
+
+func (e *EncryptSessionStore) DeleteEntry(key string) error {
+	return Delete(e.SessionEntryStore, key)
+}
+
+func (e *EncryptSessionStore) TouchEntry(key string, expiry time.Time) (bool, error) {
+	return Touch(e.SessionEntryStore, key, expiry)
+}
+
+// IterateEntries skips entries that can't be decrypted.
+func (e *EncryptSessionStore) IterateEntries(fn func(key string, entry *SessionEntry) bool) error {
+	return Iterate(e.SessionEntryStore, func(key string, entry *SessionEntry) bool {
+		data, ok, err := e.open(key, entry.Data)
+		if err != nil || !ok {
+			return true
+		}
+		return fn(key, &SessionEntry{Data: data, SessionExpiry: entry.SessionExpiry, Version: entry.Version})
+	})
+}
+
+func (e *EncryptSessionStore) seal(key string, data []byte) ([]byte, error) {
+	aead := e.aeads[e.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := append([]byte{e.current}, nonce...)
+	return aead.Seal(sealed, nonce, data, []byte(key)), nil
+}
+
+func (e *EncryptSessionStore) open(key string, sealed []byte) (data []byte, ok bool, err error) {
+	if len(sealed) == 0 {
+		return nil, false, nil
+	}
+	aead, ok := e.aeads[sealed[0]]
+	if !ok {
+		return nil, false, nil
+	}
+	sealed = sealed[1:]
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, false, ErrDecrypt
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	data, err = aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, false, ErrDecrypt
+	}
+	return data, true, nil
+}
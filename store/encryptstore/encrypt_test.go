@@ -0,0 +1,95 @@
+package encryptstore
+
+import (
+	"bytes"
+	. "github.com/timob/httpsession/store"
+	"github.com/timob/httpsession/store/mapstore"
+	"github.com/timob/httpsession/store/storetest"
+	"testing"
+	"time"
+)
+
+var (
+	key1 = Key{1, bytes.Repeat([]byte{1}, 32)}
+	key2 = Key{2, bytes.Repeat([]byte{2}, 16)}
+)
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t testing.TB) SessionEntryStore {
+		e, err := NewEncryptSessionStore(mapstore.NewMapSessionStore(), key1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	})
+}
+
+func TestEncryptStore(t *testing.T) {
+	backing := mapstore.NewMapSessionStore()
+	e, err := NewEncryptSessionStore(backing, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte(`{"password":"hunter2"}`)
+	expiry := time.Now().Add(time.Minute)
+	e.AddEntry("a", &SessionEntry{Data: secret, SessionExpiry: expiry})
+
+	raw, _, _ := backing.FindEntry("a")
+	if bytes.Contains(raw.Data, []byte("hunter2")) || raw.Data[0] != key1.ID {
+		t.Fatalf("expected sealed data with key id prefix, got %q", raw.Data)
+	}
+
+	// an entry moved to another session key must not decrypt
+	backing.AddEntry("b", raw)
+	if _, _, err = e.FindEntry("b"); err != ErrDecrypt {
+		t.Fatalf("expected ErrDecrypt for entry under wrong key, got %v", err)
+	}
+
+	raw.Data[len(raw.Data)-1] ^= 1
+	backing.AddEntry("a", raw)
+	if _, _, err = e.FindEntry("a"); err != ErrDecrypt {
+		t.Fatalf("expected ErrDecrypt for tampered entry, got %v", err)
+	}
+}
+
+func TestEncryptStoreRotation(t *testing.T) {
+	backing := mapstore.NewMapSessionStore()
+	old, _ := NewEncryptSessionStore(backing, key1)
+	old.AddEntry("a", &SessionEntry{Data: []byte("old"), SessionExpiry: time.Now().Add(time.Minute)})
+
+	rotated, err := NewEncryptSessionStore(backing, key2, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, ok, err := rotated.FindEntry("a")
+	if err != nil || !ok || string(entry.Data) != "old" {
+		t.Fatalf("expected entry sealed with old key to be readable, got %v %v %v", entry, ok, err)
+	}
+	rotated.AddEntry("a", entry)
+	raw, _, _ := backing.FindEntry("a")
+	if raw.Data[0] != key2.ID {
+		t.Fatal("expected new writes to use the current key")
+	}
+
+	retired, _ := NewEncryptSessionStore(backing, key1)
+	if _, ok, err = retired.FindEntry("a"); ok || err != nil {
+		t.Fatalf("expected entry with unknown key id to be missing, got ok %v err %v", ok, err)
+	}
+
+	if _, err = NewEncryptSessionStore(backing, key1, key1); err == nil {
+		t.Fatal("expected duplicate key id to be rejected")
+	}
+	if _, err = NewEncryptSessionStore(backing, Key{3, []byte("short")}); err == nil {
+		t.Fatal("expected invalid key size to be rejected")
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	storetest.RunForwarding(t, func(t testing.TB, inner SessionEntryStore) SessionEntryStore {
+		e, err := NewEncryptSessionStore(inner, key1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	})
+}
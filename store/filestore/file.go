@@ -0,0 +1,208 @@
+// Package filestore stores each session entry in its own file so that sessions
+// survive process restarts.
+package filestore
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	. "github.com/timob/httpsession/store"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileSuffix = ".sess"
+	tempPrefix = ".tmp-"
+	headerSize = 8
+)
+
+var errShortFile = errors.New("filestore: session file too short")
+
+// FileSessionStore keeps entries under dir/xx/yy/<sha256 of key>.sess. Keys are
+// hashed so that client supplied ids can never escape dir.
+type FileSessionStore struct {
+	dir  string
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewFileSessionStore creates dir if needed. If janitorInterval is greater than
+// zero, a goroutine removes expired entries at that interval until Close is
+// called.
+func NewFileSessionStore(dir string, janitorInterval time.Duration) (*FileSessionStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	f := &FileSessionStore{dir: dir}
+	if janitorInterval > 0 {
+		f.stop = make(chan struct{})
+		f.done = make(chan struct{})
+		go f.janitor(janitorInterval)
+	}
+	return f, nil
+}
+
+func (f *FileSessionStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(f.dir, name[0:2], name[2:4], name+fileSuffix)
+}
+
+func (f *FileSessionStore) FindEntry(key string) (*SessionEntry, bool, error) {
+	entry, err := readEntry(f.path(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return entry, true, nil
+}
+
+func (f *FileSessionStore) AddEntry(key string, entry *SessionEntry) (err error) {
+	name := f.path(key)
+	dir := filepath.Dir(name)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+
+	tmp, err := os.CreateTemp(dir, tempPrefix)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	var header [headerSize]byte
+	binary.BigEndian.PutUint64(header[:], uint64(entry.SessionExpiry.UnixNano()))
+	_, err = tmp.Write(header[:])
+	if err == nil {
+		_, err = tmp.Write(entry.Data)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (f *FileSessionStore) DeleteEntry(key string) error {
+	err := os.Remove(f.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// TouchEntry rewrites the expiry header in place, leaving the data untouched.
+func (f *FileSessionStore) TouchEntry(key string, expiry time.Time) (ok bool, err error) {
+	file, err := os.OpenFile(f.path(key), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer func() {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	var header [headerSize]byte
+	if _, err = io.ReadFull(file, header[:]); err != nil {
+		return false, nil
+	}
+	if time.Now().After(time.Unix(0, int64(binary.BigEndian.Uint64(header[:])))) {
+		return false, nil
+	}
+	binary.BigEndian.PutUint64(header[:], uint64(expiry.UnixNano()))
+	if _, err = file.WriteAt(header[:], 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RemoveExpired deletes the files of all expired entries, and any temporary
+// files left behind by an interrupted write.
+func (f *FileSessionStore) RemoveExpired() error {
+	now := time.Now()
+	return filepath.Walk(f.dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		base := filepath.Base(name)
+		if strings.HasPrefix(base, tempPrefix) {
+			if now.Sub(info.ModTime()) > time.Hour {
+				os.Remove(name)
+			}
+			return nil
+		}
+		if !strings.HasSuffix(base, fileSuffix) {
+			return nil
+		}
+		entry, err := readEntry(name)
+		if err == errShortFile || (err == nil && now.After(entry.SessionExpiry)) {
+			os.Remove(name)
+		}
+		return nil
+	})
+}
+
+// Close stops the janitor goroutine, if one was started.
+func (f *FileSessionStore) Close() error {
+	if f.stop != nil {
+		f.once.Do(func() {
+			close(f.stop)
+			<-f.done
+		})
+	}
+	return nil
+}
+
+func (f *FileSessionStore) janitor(interval time.Duration) {
+	defer close(f.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.RemoveExpired()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+func readEntry(name string) (*SessionEntry, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < headerSize {
+		return nil, errShortFile
+	}
+	expiry := time.Unix(0, int64(binary.BigEndian.Uint64(b[:headerSize])))
+	return &SessionEntry{Data: b[headerSize:], SessionExpiry: expiry}, nil
+}
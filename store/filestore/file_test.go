@@ -0,0 +1,64 @@
+package filestore
+
+import (
+	. "github.com/timob/httpsession/store"
+	"github.com/timob/httpsession/store/storetest"
+	"os"
+	"testing"
+	"time"
+)
+
+func newStore(t testing.TB) SessionEntryStore {
+	f, err := NewFileSessionStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, newStore)
+}
+
+func TestRemoveExpired(t *testing.T) {
+	f := newStore(t).(*FileSessionStore)
+	f.AddEntry("old", &SessionEntry{Data: []byte("x"), SessionExpiry: time.Now().Add(-time.Minute)})
+	f.AddEntry("new", &SessionEntry{Data: []byte("x"), SessionExpiry: time.Now().Add(time.Minute)})
+	if err := f.RemoveExpired(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := f.FindEntry("old"); ok {
+		t.Fatal("expected expired entry to be removed")
+	}
+	if _, ok, _ := f.FindEntry("new"); !ok {
+		t.Fatal("expected unexpired entry to be kept")
+	}
+}
+
+func BenchmarkConformance(b *testing.B) {
+	storetest.RunBenchmarks(b, newStore)
+}
+
+func TestTouchDelete(t *testing.T) {
+	f := newStore(t).(*FileSessionStore)
+	f.AddEntry("a", &SessionEntry{Data: []byte("data"), SessionExpiry: time.Now().Add(-time.Minute)})
+	if ok, err := f.TouchEntry("a", time.Now().Add(time.Hour)); ok || err != nil {
+		t.Fatalf("expected expired entry not to be touched, got %v %v", ok, err)
+	}
+
+	f.AddEntry("a", &SessionEntry{Data: []byte("data"), SessionExpiry: time.Now().Add(time.Minute)})
+	expiry := time.Now().Add(time.Hour)
+	if ok, err := f.TouchEntry("a", expiry); !ok || err != nil {
+		t.Fatalf("TouchEntry: %v %v", ok, err)
+	}
+	if entry, _, _ := f.FindEntry("a"); string(entry.Data) != "data" || !entry.SessionExpiry.Equal(time.Unix(0, expiry.UnixNano())) {
+		t.Fatalf("unexpected entry after touch: %q %v", entry.Data, entry.SessionExpiry)
+	}
+
+	if err := f.DeleteEntry("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f.path("a")); !os.IsNotExist(err) {
+		t.Fatal("expected DeleteEntry to remove the file")
+	}
+}
@@ -0,0 +1,29 @@
+package mapstore_test
+
+import (
+	. "github.com/timob/httpsession/store"
+	. "github.com/timob/httpsession/store/mapstore"
+	"github.com/timob/httpsession/store/storetest"
+	"testing"
+)
+
+// The conformance tests are in an external test package, so that storetest
+// can use mapstore as the inner store of decorators.
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(testing.TB) SessionEntryStore {
+		return NewMapSessionStore()
+	})
+}
+
+func TestShardedConformance(t *testing.T) {
+	storetest.RunConformance(t, func(testing.TB) SessionEntryStore {
+		return NewShardedMapSessionStore(4, Options{})
+	})
+}
+
+func BenchmarkConformance(b *testing.B) {
+	storetest.RunBenchmarks(b, func(testing.TB) SessionEntryStore {
+		return NewMapSessionStore()
+	})
+}
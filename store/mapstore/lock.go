@@ -0,0 +1,81 @@
+package mapstore
+
+import (
+	"context"
+	. "github.com/timob/httpsession/store"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type entryLock struct {
+	lockToken string
+	expires   time.Time
+	released  chan struct{}
+}
+
+// locks implements Locker for the goroutines of one process.
+type locks struct {
+	held map[string]*entryLock
+	next uint64
+	sync.Mutex
+}
+
+func (l *locks) LockEntry(ctx context.Context, key string, lease time.Duration) (string, error) {
+	for {
+		l.Lock()
+		if l.held == nil {
+			l.held = make(map[string]*entryLock)
+		}
+		now := time.Now()
+		held, ok := l.held[key]
+		if !ok || now.After(held.expires) {
+			if ok {
+				close(held.released)
+			}
+			l.next++
+			lock := &entryLock{strconv.FormatUint(l.next, 10), now.Add(lease), make(chan struct{})}
+			l.held[key] = lock
+			l.Unlock()
+			return lock.lockToken, nil
+		}
+		l.Unlock()
+
+		timer := time.NewTimer(held.expires.Sub(now))
+		select {
+		case <-held.released:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// removeExpired drops locks whose lease has run out without being released.
+func (l *locks) removeExpired() {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	for key, held := range l.held {
+		if now.After(held.expires) {
+			delete(l.held, key)
+			close(held.released)
+		}
+	}
+}
+
+func (l *locks) UnlockEntry(key string, lockToken string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	held, ok := l.held[key]
+	if !ok || held.lockToken != lockToken {
+		return ErrLockNotHeld
+	}
+	delete(l.held, key)
+	close(held.released)
+	return nil
+}
@@ -1,23 +1,93 @@
 package mapstore
 
 import (
+	"container/list"
+	"context"
 	. "github.com/timob/httpsession/store"
 	"sync"
 	"time"
 )
 
+type Options struct {
+	// MaxEntries limits the number of entries. The least recently used entry
+	// is evicted when it is exceeded. Zero means no limit.
+	MaxEntries int
+	// MaxBytes limits the total size of entry data, evicting like MaxEntries.
+	// Zero means no limit.
+	MaxBytes int64
+	// SweepInterval starts a goroutine that removes expired entries at this
+	// interval until Close is called. Zero means no sweeper.
+	SweepInterval time.Duration
+}
+
+// minSweepAt is the size at which a store without limits or a sweeper first
+// removes expired entries on write.
+const minSweepAt = 1000
+
+type mapEntry struct {
+	key   string
+	entry *SessionEntry
+}
+
+// MapSessionStore is safe for concurrent use. Entries are copied on the way in
+// and out, so callers never share memory with the store.
 type MapSessionStore struct {
-	data map[string]*SessionEntry
-	*sync.Mutex
+	data  map[string]*list.Element
+	lru   *list.List
+	bytes int64
+	opts  Options
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+	*sync.RWMutex
+	// locks is separate from the entries, waiting for a lock must not block
+	// other sessions.
+	locks locks
+
+	// sweepAt is the size that triggers the next sweep on write. It is twice
+	// the size left by the last sweep, so sweeps cost O(1) per write.
+	sweepAt int
 }
 
 func NewMapSessionStore() *MapSessionStore {
-	return &MapSessionStore{make(map[string]*SessionEntry), &sync.Mutex{}}
+	return NewMapSessionStoreWithOptions(Options{})
+}
+
+func NewMapSessionStoreWithOptions(opts Options) *MapSessionStore {
+	m := newMapSessionStore(opts)
+	if opts.SweepInterval > 0 {
+		m.stop = make(chan struct{})
+		m.done = make(chan struct{})
+		go m.sweeper(opts.SweepInterval)
+	}
+	return m
+}
+
+func newMapSessionStore(opts Options) *MapSessionStore {
+	return &MapSessionStore{
+		data:    make(map[string]*list.Element),
+		lru:     list.New(),
+		sweepAt: minSweepAt,
+		opts:    opts,
+		RWMutex: &sync.RWMutex{},
+	}
 }
 
 func (m *MapSessionStore) FindEntry(key string) (*SessionEntry, bool, error) {
-	if entry, ok := m.data[key]; ok {
-		return entry, true, nil
+	// Without limits the recency order is unused, so readers can share the lock.
+	if m.bounded() {
+		m.Lock()
+		defer m.Unlock()
+	} else {
+		m.RLock()
+		defer m.RUnlock()
+	}
+
+	if elem, ok := m.data[key]; ok {
+		if m.bounded() {
+			m.lru.MoveToFront(elem)
+		}
+		return copyEntry(elem.Value.(*mapEntry).entry), true, nil
 	}
 	return nil, false, nil
 }
@@ -26,17 +96,174 @@ func (m *MapSessionStore) AddEntry(key string, entry *SessionEntry) error {
 	m.Lock()
 	defer m.Unlock()
 
-	if e, ok := m.data[key]; ok {
-		*e = *entry
+	m.add(key, entry)
+	return nil
+}
+
+func (m *MapSessionStore) CompareAndSwapEntry(key string, version uint64, entry *SessionEntry) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var current uint64
+	if elem, ok := m.data[key]; ok {
+		current = elem.Value.(*mapEntry).entry.Version
+	}
+	if current != version {
+		return false, nil
+	}
+	entry.Version = m.add(key, entry)
+	return true, nil
+}
+
+// add stores a copy of entry with the next version and returns that version.
+func (m *MapSessionStore) add(key string, entry *SessionEntry) uint64 {
+	entry = copyEntry(entry)
+	if elem, ok := m.data[key]; ok {
+		e := elem.Value.(*mapEntry)
+		m.bytes += int64(len(entry.Data) - len(e.entry.Data))
+		entry.Version = e.entry.Version + 1
+		e.entry = entry
+		m.lru.MoveToFront(elem)
 	} else {
-		m.data[key] = entry
+		entry.Version = 1
+		m.data[key] = m.lru.PushFront(&mapEntry{key, entry})
+		m.bytes += int64(len(entry.Data))
+	}
+	version := entry.Version
+
+	if !m.bounded() {
+		if m.opts.SweepInterval == 0 && len(m.data) > m.sweepAt {
+			m.removeExpired()
+			m.sweepAt = max(minSweepAt, 2*len(m.data))
+		}
+		return version
+	}
+	for m.lru.Len() > 1 &&
+		((m.opts.MaxEntries > 0 && m.lru.Len() > m.opts.MaxEntries) ||
+			(m.opts.MaxBytes > 0 && m.bytes > m.opts.MaxBytes)) {
+		m.remove(m.lru.Back())
+	}
+	return version
+}
+
+func (m *MapSessionStore) LockEntry(ctx context.Context, key string, lease time.Duration) (string, error) {
+	return m.locks.LockEntry(ctx, key, lease)
+}
+
+func (m *MapSessionStore) UnlockEntry(key string, lockToken string) error {
+	return m.locks.UnlockEntry(key, lockToken)
+}
+
+func (m *MapSessionStore) DeleteEntry(key string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if elem, ok := m.data[key]; ok {
+		m.remove(elem)
+	}
+	return nil
+}
+
+func (m *MapSessionStore) TouchEntry(key string, expiry time.Time) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	elem, ok := m.data[key]
+	if !ok {
+		return false, nil
 	}
-	if len(m.data) > 1000 {
-		for k, entry := range m.data {
-			if time.Now().After(entry.SessionExpiry) {
-				delete(m.data, k)
-			}
+	// Stored entries are never modified in place, IterateEntries copies them
+	// after unlocking.
+	e := elem.Value.(*mapEntry)
+	touched := *e.entry
+	touched.SessionExpiry = expiry
+	e.entry = &touched
+	m.lru.MoveToFront(elem)
+	return true, nil
+}
+
+// IterateEntries calls fn on a snapshot of the store, so fn may use the store.
+func (m *MapSessionStore) IterateEntries(fn func(key string, entry *SessionEntry) bool) error {
+	m.RLock()
+	keys := make([]string, 0, len(m.data))
+	entries := make([]*SessionEntry, 0, len(m.data))
+	for k, elem := range m.data {
+		keys = append(keys, k)
+		entries = append(entries, elem.Value.(*mapEntry).entry)
+	}
+	m.RUnlock()
+
+	for i, k := range keys {
+		if !fn(k, copyEntry(entries[i])) {
+			break
 		}
 	}
 	return nil
 }
+
+// Len returns the number of entries and the total size of their data.
+func (m *MapSessionStore) Len() (entries int, bytes int64) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return len(m.data), m.bytes
+}
+
+// RemoveExpired removes all expired entries and locks.
+func (m *MapSessionStore) RemoveExpired() {
+	m.Lock()
+	m.removeExpired()
+	m.Unlock()
+
+	m.locks.removeExpired()
+}
+
+// Close stops the sweeper goroutine, if one was started.
+func (m *MapSessionStore) Close() error {
+	if m.stop != nil {
+		m.once.Do(func() {
+			close(m.stop)
+			<-m.done
+		})
+	}
+	return nil
+}
+
+func (m *MapSessionStore) bounded() bool {
+	return m.opts.MaxEntries > 0 || m.opts.MaxBytes > 0
+}
+
+func (m *MapSessionStore) removeExpired() {
+	now := time.Now()
+	for _, elem := range m.data {
+		if now.After(elem.Value.(*mapEntry).entry.SessionExpiry) {
+			m.remove(elem)
+		}
+	}
+}
+
+func (m *MapSessionStore) remove(elem *list.Element) {
+	e := m.lru.Remove(elem).(*mapEntry)
+	delete(m.data, e.key)
+	m.bytes -= int64(len(e.entry.Data))
+}
+
+func (m *MapSessionStore) sweeper(interval time.Duration) {
+	defer close(m.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.RemoveExpired()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func copyEntry(e *SessionEntry) *SessionEntry {
+	c := *e
+	c.Data = append([]byte(nil), e.Data...)
+	return &c
+}
@@ -0,0 +1,220 @@
+package mapstore
+
+import (
+	"context"
+	. "github.com/timob/httpsession/store"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMapStoreLRU(t *testing.T) {
+	m := NewMapSessionStoreWithOptions(Options{MaxEntries: 2, MaxBytes: 10})
+	expiry := time.Now().Add(time.Minute)
+
+	m.AddEntry("a", &SessionEntry{Data: []byte("aaa"), SessionExpiry: expiry})
+	m.AddEntry("b", &SessionEntry{Data: []byte("bbb"), SessionExpiry: expiry})
+	m.FindEntry("a")
+	m.AddEntry("c", &SessionEntry{Data: []byte("ccc"), SessionExpiry: expiry})
+	if _, ok, _ := m.FindEntry("b"); ok {
+		t.Fatal("expected least recently used entry b to be evicted")
+	}
+	if _, ok, _ := m.FindEntry("a"); !ok {
+		t.Fatal("expected recently used entry a to be kept")
+	}
+
+	m.AddEntry("d", &SessionEntry{Data: []byte("dddddddd"), SessionExpiry: expiry})
+	if n, size := m.Len(); n != 1 || size != 8 {
+		t.Fatalf("expected byte limit to leave only d, got %d entries of %d bytes", n, size)
+	}
+}
+
+func TestMapStoreSweeper(t *testing.T) {
+	m := NewMapSessionStoreWithOptions(Options{SweepInterval: 10 * time.Millisecond})
+	defer m.Close()
+
+	m.AddEntry("old", &SessionEntry{Data: []byte("x"), SessionExpiry: time.Now()})
+	m.AddEntry("new", &SessionEntry{Data: []byte("x"), SessionExpiry: time.Now().Add(time.Minute)})
+	deadline := time.Now().Add(time.Second)
+	for {
+		if n, _ := m.Len(); n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected sweeper to remove expired entry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok, _ := m.FindEntry("new"); !ok {
+		t.Fatal("expected unexpired entry to be kept")
+	}
+}
+
+func TestMapStoreSweepOnWrite(t *testing.T) {
+	m := NewMapSessionStore()
+	for i := 0; i < minSweepAt; i++ {
+		m.AddEntry(strconv.Itoa(i), &SessionEntry{Data: []byte("x"), SessionExpiry: time.Now().Add(-time.Minute)})
+	}
+	m.AddEntry("new", &SessionEntry{Data: []byte("x"), SessionExpiry: time.Now().Add(time.Minute)})
+	if n, _ := m.Len(); n != 1 {
+		t.Fatalf("expected expired entries to be swept, %d left", n)
+	}
+	if m.sweepAt != minSweepAt {
+		t.Fatalf("expected sweep threshold to stay at %d, got %d", minSweepAt, m.sweepAt)
+	}
+}
+
+func TestMapStoreRemoveExpiredLocks(t *testing.T) {
+	m := NewMapSessionStore()
+	ctx := context.Background()
+	m.LockEntry(ctx, "old", time.Millisecond)
+	m.LockEntry(ctx, "new", time.Minute)
+	time.Sleep(5 * time.Millisecond)
+	m.RemoveExpired()
+	if len(m.locks.held) != 1 || m.locks.held["new"] == nil {
+		t.Fatalf("expected only the unexpired lock to be kept, got %v", m.locks.held)
+	}
+}
+
+func TestMapStoreCopies(t *testing.T) {
+	m := NewMapSessionStore()
+	data := []byte("abc")
+	m.AddEntry("a", &SessionEntry{Data: data, SessionExpiry: time.Now().Add(time.Minute)})
+	data[0] = 'x'
+
+	entry, _, _ := m.FindEntry("a")
+	if string(entry.Data) != "abc" {
+		t.Fatalf("expected store to copy added data, got %q", entry.Data)
+	}
+	entry.Data[0] = 'y'
+	entry.SessionExpiry = time.Time{}
+
+	entry, _, _ = m.FindEntry("a")
+	if string(entry.Data) != "abc" || entry.SessionExpiry.IsZero() {
+		t.Fatal("expected store to return copies")
+	}
+}
+
+type concurrentStore interface {
+	SessionEntryStore
+	Deleter
+	Toucher
+	Iterator
+}
+
+func testConcurrent(t *testing.T, m concurrentStore) {
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := strconv.Itoa(i % 20)
+				switch (g + i) % 5 {
+				case 0:
+					m.AddEntry(key, &SessionEntry{Data: []byte(key), SessionExpiry: time.Now().Add(time.Minute)})
+				case 1:
+					if entry, ok, _ := m.FindEntry(key); ok && string(entry.Data) != key {
+						t.Errorf("key %s has data %q", key, entry.Data)
+					}
+				case 2:
+					m.TouchEntry(key, time.Now().Add(time.Hour))
+				case 3:
+					m.DeleteEntry(key)
+				case 4:
+					m.IterateEntries(func(k string, entry *SessionEntry) bool {
+						return string(entry.Data) == k
+					})
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestMapStoreConcurrent(t *testing.T) {
+	testConcurrent(t, NewMapSessionStore())
+	testConcurrent(t, NewMapSessionStoreWithOptions(Options{MaxEntries: 10}))
+}
+
+func TestShardedMapStoreConcurrent(t *testing.T) {
+	s := NewShardedMapSessionStore(4, Options{MaxEntries: 100, SweepInterval: time.Millisecond})
+	defer s.Close()
+	testConcurrent(t, s)
+}
+
+func TestShardedMapStore(t *testing.T) {
+	s := NewShardedMapSessionStore(4, Options{})
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		s.AddEntry(key, &SessionEntry{Data: []byte(key), SessionExpiry: time.Now().Add(time.Minute)})
+	}
+	if n, _ := s.Len(); n != 100 {
+		t.Fatalf("expected 100 entries, got %d", n)
+	}
+	for _, shard := range s.shards {
+		if n, _ := shard.Len(); n == 0 {
+			t.Fatal("expected keys to be spread over all shards")
+		}
+	}
+	seen := 0
+	s.IterateEntries(func(key string, entry *SessionEntry) bool {
+		seen++
+		return seen < 10
+	})
+	if seen != 10 {
+		t.Fatalf("expected iteration to stop after 10 entries, got %d", seen)
+	}
+}
+
+func benchmarkStore(b *testing.B, m SessionEntryStore) {
+	for i := 0; i < 1000; i++ {
+		m.AddEntry(strconv.Itoa(i), &SessionEntry{Data: make([]byte, 256), SessionExpiry: time.Now().Add(time.Hour)})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		entry := &SessionEntry{Data: make([]byte, 256), SessionExpiry: time.Now().Add(time.Hour)}
+		i := 0
+		for pb.Next() {
+			key := strconv.Itoa(i % 1000)
+			if i%10 == 0 {
+				m.AddEntry(key, entry)
+			} else {
+				m.FindEntry(key)
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkMapStoreAdd writes new keys to stores of growing size. Expired
+// entries are swept on write, so ns/op stays flat only if sweeps are
+// amortized.
+func BenchmarkMapStoreAdd(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			m := NewMapSessionStore()
+			entry := &SessionEntry{Data: make([]byte, 16), SessionExpiry: time.Now().Add(time.Hour)}
+			for i := 0; i < size; i++ {
+				m.AddEntry(strconv.Itoa(i), entry)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.AddEntry(strconv.Itoa(size+i), entry)
+			}
+		})
+	}
+}
+
+func BenchmarkMapStore(b *testing.B) {
+	benchmarkStore(b, NewMapSessionStore())
+}
+
+func BenchmarkMapStoreLRU(b *testing.B) {
+	benchmarkStore(b, NewMapSessionStoreWithOptions(Options{MaxEntries: 2000}))
+}
+
+func BenchmarkShardedMapStore(b *testing.B) {
+	benchmarkStore(b, NewShardedMapSessionStore(16, Options{MaxEntries: 2000}))
+}
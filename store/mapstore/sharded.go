@@ -0,0 +1,134 @@
+package mapstore
+
+import (
+	"context"
+	. "github.com/timob/httpsession/store"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// ShardedMapSessionStore spreads keys over several MapSessionStores so that
+// writers on different keys don't contend for one lock.
+type ShardedMapSessionStore struct {
+	shards []*MapSessionStore
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewShardedMapSessionStore creates a store with the given number of shards.
+// The limits in opts are divided between the shards, so eviction is per shard
+// and only approximately least recently used overall.
+func NewShardedMapSessionStore(shards int, opts Options) *ShardedMapSessionStore {
+	if shards < 1 {
+		shards = 1
+	}
+	// The shards are told about the sweep interval so they skip their
+	// opportunistic sweeps, but they don't start their own sweepers.
+	shardOpts := Options{
+		MaxEntries:    (opts.MaxEntries + shards - 1) / shards,
+		MaxBytes:      (opts.MaxBytes + int64(shards) - 1) / int64(shards),
+		SweepInterval: opts.SweepInterval,
+	}
+	s := &ShardedMapSessionStore{shards: make([]*MapSessionStore, shards)}
+	for i := range s.shards {
+		s.shards[i] = newMapSessionStore(shardOpts)
+	}
+	if opts.SweepInterval > 0 {
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.sweeper(opts.SweepInterval)
+	}
+	return s
+}
+
+func (s *ShardedMapSessionStore) shard(key string) *MapSessionStore {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *ShardedMapSessionStore) FindEntry(key string) (*SessionEntry, bool, error) {
+	return s.shard(key).FindEntry(key)
+}
+
+func (s *ShardedMapSessionStore) AddEntry(key string, entry *SessionEntry) error {
+	return s.shard(key).AddEntry(key, entry)
+}
+
+func (s *ShardedMapSessionStore) CompareAndSwapEntry(key string, version uint64, entry *SessionEntry) (bool, error) {
+	return s.shard(key).CompareAndSwapEntry(key, version, entry)
+}
+
+func (s *ShardedMapSessionStore) LockEntry(ctx context.Context, key string, lease time.Duration) (string, error) {
+	return s.shard(key).LockEntry(ctx, key, lease)
+}
+
+func (s *ShardedMapSessionStore) UnlockEntry(key string, lockToken string) error {
+	return s.shard(key).UnlockEntry(key, lockToken)
+}
+
+func (s *ShardedMapSessionStore) DeleteEntry(key string) error {
+	return s.shard(key).DeleteEntry(key)
+}
+
+func (s *ShardedMapSessionStore) TouchEntry(key string, expiry time.Time) (bool, error) {
+	return s.shard(key).TouchEntry(key, expiry)
+}
+
+func (s *ShardedMapSessionStore) IterateEntries(fn func(key string, entry *SessionEntry) bool) error {
+	more := true
+	for _, shard := range s.shards {
+		shard.IterateEntries(func(key string, entry *SessionEntry) bool {
+			more = fn(key, entry)
+			return more
+		})
+		if !more {
+			break
+		}
+	}
+	return nil
+}
+
+// Len returns the number of entries and the total size of their data.
+func (s *ShardedMapSessionStore) Len() (entries int, bytes int64) {
+	for _, shard := range s.shards {
+		n, b := shard.Len()
+		entries += n
+		bytes += b
+	}
+	return
+}
+
+// RemoveExpired removes all expired entries and locks.
+func (s *ShardedMapSessionStore) RemoveExpired() {
+	for _, shard := range s.shards {
+		shard.RemoveExpired()
+	}
+}
+
+// Close stops the sweeper goroutine, if one was started.
+func (s *ShardedMapSessionStore) Close() error {
+	if s.stop != nil {
+		s.once.Do(func() {
+			close(s.stop)
+			<-s.done
+		})
+	}
+	return nil
+}
+
+func (s *ShardedMapSessionStore) sweeper(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.RemoveExpired()
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Package redisstore stores session entries in Redis. It speaks the RESP
+// protocol directly and lets Redis expire entries itself.
+package redisstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/timob/httpsession/store"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("redisstore: store closed")
+
+// noExpiry is reported for keys that Redis holds without a TTL.
+var noExpiry = time.Unix(1<<62/int64(time.Second), 0)
+
+type Options struct {
+	Network string // defaults to "tcp"
+	Addr    string
+	// Prefix is prepended to every session key.
+	Prefix   string
+	Password string
+	DB       int
+	// MaxIdle is the number of idle connections kept for reuse. Defaults to 4.
+	MaxIdle      int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+type RedisSessionStore struct {
+	opts   Options
+	idle   chan *conn
+	closed bool
+	*sync.Mutex
+}
+
+func NewRedisSessionStore(opts Options) *RedisSessionStore {
+	if opts.Network == "" {
+		opts.Network = "tcp"
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = 4
+	}
+	return &RedisSessionStore{opts: opts, idle: make(chan *conn, opts.MaxIdle), Mutex: &sync.Mutex{}}
+}
+
+func (r *RedisSessionStore) FindEntry(key string) (*SessionEntry, bool, error) {
+	return r.FindEntryContext(context.Background(), key)
+}
+
+func (r *RedisSessionStore) FindEntryContext(ctx context.Context, key string) (*SessionEntry, bool, error) {
+	replies, err := r.do(ctx, []string{"GET", r.opts.Prefix + key}, []string{"PTTL", r.opts.Prefix + key})
+	if err != nil {
+		return nil, false, err
+	}
+	data, ttl := replies[0], replies[1]
+	if data == nil {
+		return nil, false, nil
+	}
+
+	var expiry time.Time
+	ms, _ := ttl.(int64)
+	switch {
+	case ms == -2:
+		// expired between GET and PTTL
+		return nil, false, nil
+	case ms < 0:
+		expiry = noExpiry
+	default:
+		expiry = time.Now().Add(time.Duration(ms) * time.Millisecond)
+	}
+	return &SessionEntry{Data: data.([]byte), SessionExpiry: expiry}, true, nil
+}
+
+func (r *RedisSessionStore) AddEntry(key string, entry *SessionEntry) error {
+	return r.AddEntryContext(context.Background(), key, entry)
+}
+
+func (r *RedisSessionStore) AddEntryContext(ctx context.Context, key string, entry *SessionEntry) error {
+	pxat := strconv.FormatInt(entry.SessionExpiry.UnixNano()/int64(time.Millisecond), 10)
+	_, err := r.do(ctx, []string{"SET", r.opts.Prefix + key, string(entry.Data), "PXAT", pxat})
+	return err
+}
+
+// TouchEntry sets the expiry with PEXPIREAT, which reports whether the key
+// exists.
+func (r *RedisSessionStore) TouchEntry(key string, expiry time.Time) (bool, error) {
+	pxat := strconv.FormatInt(expiry.UnixNano()/int64(time.Millisecond), 10)
+	replies, err := r.do(context.Background(), []string{"PEXPIREAT", r.opts.Prefix + key, pxat})
+	if err != nil {
+		return false, err
+	}
+	n, _ := replies[0].(int64)
+	return n == 1, nil
+}
+
+// Close closes idle connections. Connections in use are closed when they are
+// returned.
+func (r *RedisSessionStore) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.idle)
+	for c := range r.idle {
+		c.Close()
+	}
+	return nil
+}
+
+// do sends cmds as a pipeline and returns one reply per command. A Redis error
+// reply to any command is returned as err.
+func (r *RedisSessionStore) do(ctx context.Context, cmds ...[]string) (replies []interface{}, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	c, err := r.get(ctx)
+	if err != nil {
+		return
+	}
+
+	// Cancelling ctx expires the connection deadlines to abort blocked I/O.
+	c.deadline, _ = ctx.Deadline()
+	if done := ctx.Done(); done != nil {
+		stop, exited := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-done:
+				c.SetDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+		replies, err = c.pipeline(cmds...)
+		close(stop)
+		<-exited
+	} else {
+		replies, err = c.pipeline(cmds...)
+	}
+	if ctx.Err() != nil {
+		c.Close()
+		return nil, ctx.Err()
+	}
+
+	if _, ok := err.(redisError); ok || err == nil {
+		r.put(c)
+	} else {
+		c.Close()
+	}
+	return
+}
+
+func (r *RedisSessionStore) get(ctx context.Context) (*conn, error) {
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		return nil, ErrClosed
+	}
+	select {
+	case c := <-r.idle:
+		r.Unlock()
+		return c, nil
+	default:
+	}
+	r.Unlock()
+	return r.dial(ctx)
+}
+
+func (r *RedisSessionStore) put(c *conn) {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		c.Close()
+		return
+	}
+	select {
+	case r.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+func (r *RedisSessionStore) dial(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: r.opts.DialTimeout}
+	nc, err := d.DialContext(ctx, r.opts.Network, r.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc), readTimeout: r.opts.ReadTimeout, writeTimeout: r.opts.WriteTimeout}
+	c.deadline, _ = ctx.Deadline()
+
+	var setup [][]string
+	if r.opts.Password != "" {
+		setup = append(setup, []string{"AUTH", r.opts.Password})
+	}
+	if r.opts.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.opts.DB)})
+	}
+	if len(setup) > 0 {
+		if _, err = c.pipeline(setup...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redisstore: " + string(e)
+}
+
+type conn struct {
+	net.Conn
+	r            *bufio.Reader
+	w            *bufio.Writer
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// deadline, if set, bounds the timeouts of the current call
+	deadline time.Time
+}
+
+func (c *conn) timeout(d time.Duration) time.Time {
+	var t time.Time
+	if d > 0 {
+		t = time.Now().Add(d)
+	}
+	if !c.deadline.IsZero() && (t.IsZero() || c.deadline.Before(t)) {
+		t = c.deadline
+	}
+	return t
+}
+
+func (c *conn) pipeline(cmds ...[]string) (replies []interface{}, err error) {
+	c.SetWriteDeadline(c.timeout(c.writeTimeout))
+	for _, args := range cmds {
+		fmt.Fprintf(c.w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err = c.w.Flush(); err != nil {
+		return
+	}
+
+	c.SetReadDeadline(c.timeout(c.readTimeout))
+	// Read every reply, even after an error reply, so the connection stays in
+	// sync and can be reused.
+	var replyErr error
+	for range cmds {
+		v, err := readReply(c.r)
+		if e, ok := err.(redisError); ok {
+			if replyErr == nil {
+				replyErr = e
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		replies = append(replies, v)
+	}
+	return replies, replyErr
+}
+
+// readReply returns []byte for bulk strings, string for simple strings, int64
+// for integers, []interface{} for arrays and nil for null replies.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redisstore: malformed reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		vals := make([]interface{}, n)
+		for i := range vals {
+			if vals[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return vals, nil
+	}
+	return nil, fmt.Errorf("redisstore: unknown reply type %q", kind)
+}
@@ -0,0 +1,288 @@
+package redisstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	. "github.com/timob/httpsession/store"
+	"github.com/timob/httpsession/store/storetest"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a minimal in-process stand-in for a Redis server. It
+// understands the commands used by RedisSessionStore.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+	data     map[string][]byte
+	expiry   map[string]time.Time
+	conns    int
+	*sync.Mutex
+}
+
+func newFakeRedis(t testing.TB, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln, password, make(map[string][]byte), make(map[string]time.Time), 0, &sync.Mutex{}}
+	go f.serve()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		c, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.Lock()
+		f.conns++
+		f.Unlock()
+		go f.handle(c)
+	}
+}
+
+func (f *fakeRedis) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := f.password == ""
+	for {
+		v, err := readReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, a := range v.([]interface{}) {
+			args = append(args, string(a.([]byte)))
+		}
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" {
+			fmt.Fprint(c, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		switch cmd {
+		case "AUTH":
+			if args[1] != f.password {
+				fmt.Fprint(c, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authed = true
+			fmt.Fprint(c, "+OK\r\n")
+		case "SELECT":
+			fmt.Fprint(c, "+OK\r\n")
+		default:
+			fmt.Fprint(c, f.exec(cmd, args[1:]))
+		}
+	}
+}
+
+func (f *fakeRedis) exec(cmd string, args []string) string {
+	f.Lock()
+	defer f.Unlock()
+	if len(args) > 0 {
+		f.expire(args[0])
+	}
+	switch cmd {
+	case "GET":
+		d, ok := f.data[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(d), d)
+	case "SET":
+		if len(args) != 4 || strings.ToUpper(args[2]) != "PXAT" {
+			return "-ERR syntax error\r\n"
+		}
+		ms, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		f.data[args[0]] = []byte(args[1])
+		f.expiry[args[0]] = time.Unix(0, ms*int64(time.Millisecond))
+		f.expire(args[0])
+		return "+OK\r\n"
+	case "PEXPIREAT":
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if _, ok := f.data[args[0]]; !ok {
+			return ":0\r\n"
+		}
+		f.expiry[args[0]] = time.Unix(0, ms*int64(time.Millisecond))
+		f.expire(args[0])
+		return ":1\r\n"
+	case "PTTL":
+		if _, ok := f.data[args[0]]; !ok {
+			return ":-2\r\n"
+		}
+		e, ok := f.expiry[args[0]]
+		if !ok {
+			return ":-1\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", time.Until(e)/time.Millisecond)
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", cmd)
+}
+
+func (f *fakeRedis) expire(key string) {
+	if e, ok := f.expiry[key]; ok && !time.Now().Before(e) {
+		delete(f.data, key)
+		delete(f.expiry, key)
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	srv := newFakeRedis(t, "pw")
+	r := NewRedisSessionStore(Options{Addr: srv.ln.Addr().String(), Prefix: "sess:", Password: "pw", DB: 2})
+	defer r.Close()
+
+	_, ok, err := r.FindEntry("missing")
+	if err != nil || ok {
+		t.Fatalf("expected missing entry, got ok %v err %v", ok, err)
+	}
+
+	data := []byte("binary\r\n\x00data")
+	expiry := time.Now().Add(time.Minute)
+	if err = r.AddEntry("a", &SessionEntry{Data: data, SessionExpiry: expiry}); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok, err := r.FindEntry("a")
+	if err != nil || !ok {
+		t.Fatalf("expected entry, got ok %v err %v", ok, err)
+	}
+	if !bytes.Equal(entry.Data, data) {
+		t.Fatalf("got data %q", entry.Data)
+	}
+	if d := entry.SessionExpiry.Sub(expiry); d > time.Second || d < -time.Second {
+		t.Fatalf("expiry off by %s", d)
+	}
+	srv.Lock()
+	_, prefixed := srv.data["sess:a"]
+	srv.Unlock()
+	if !prefixed {
+		t.Fatal("expected key to be stored with prefix")
+	}
+
+	if err = r.AddEntry("a", &SessionEntry{Data: data, SessionExpiry: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ = r.FindEntry("a"); ok {
+		t.Fatal("expected entry saved with past expiry to be gone")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t testing.TB) SessionEntryStore {
+		srv := newFakeRedis(t, "")
+		r := NewRedisSessionStore(Options{Addr: srv.ln.Addr().String()})
+		t.Cleanup(func() { r.Close() })
+		return r
+	})
+}
+
+func TestRedisStorePool(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	r := NewRedisSessionStore(Options{Addr: srv.ln.Addr().String(), MaxIdle: 2})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := strconv.Itoa(i)
+			err := r.AddEntry(key, &SessionEntry{Data: []byte(key), SessionExpiry: time.Now().Add(time.Minute)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			entry, ok, err := r.FindEntry(key)
+			if err != nil || !ok || string(entry.Data) != key {
+				t.Errorf("key %s: entry %v ok %v err %v", key, entry, ok, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	srv.Lock()
+	before := srv.conns
+	srv.Unlock()
+	for i := 0; i < 10; i++ {
+		r.FindEntry("0")
+	}
+	srv.Lock()
+	after := srv.conns
+	srv.Unlock()
+	if after != before {
+		t.Fatalf("expected idle connections to be reused, dialed %d more", after-before)
+	}
+
+	r.Close()
+	if _, _, err := r.FindEntry("0"); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestRedisStoreErrors(t *testing.T) {
+	srv := newFakeRedis(t, "pw")
+	r := NewRedisSessionStore(Options{Addr: srv.ln.Addr().String(), Password: "wrong"})
+	defer r.Close()
+	if _, _, err := r.FindEntry("a"); err == nil {
+		t.Fatal("expected auth error")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// accept and never reply
+		c, err := ln.Accept()
+		if err == nil {
+			defer c.Close()
+			time.Sleep(200 * time.Millisecond)
+		}
+	}()
+	r = NewRedisSessionStore(Options{Addr: ln.Addr().String(), ReadTimeout: 50 * time.Millisecond})
+	defer r.Close()
+	if _, _, err := r.FindEntry("a"); err == nil {
+		t.Fatal("expected read timeout")
+	}
+}
+
+func TestRedisStoreContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// accept and never reply
+		c, err := ln.Accept()
+		if err == nil {
+			defer c.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	r := NewRedisSessionStore(Options{Addr: ln.Addr().String()})
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, _, err = r.FindEntryContext(ctx, "a"); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("expected cancel to abort the blocked call")
+	}
+}
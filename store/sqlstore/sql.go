@@ -0,0 +1,145 @@
+// Package sqlstore stores session entries in a database table using
+// database/sql. Any registered driver can be used.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	. "github.com/timob/httpsession/store"
+	"regexp"
+	"time"
+)
+
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+	MySQL
+)
+
+var validTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLSessionStore keeps entries in a table with the columns session_key, data
+// and expiry. Expiry is stored as Unix nanoseconds.
+type SQLSessionStore struct {
+	db      *sql.DB
+	table   string
+	dialect Dialect
+}
+
+func NewSQLSessionStore(db *sql.DB, table string, dialect Dialect) (*SQLSessionStore, error) {
+	if !validTableName.MatchString(table) {
+		return nil, fmt.Errorf("sqlstore: invalid table name %q", table)
+	}
+	switch dialect {
+	case SQLite, Postgres, MySQL:
+	default:
+		return nil, fmt.Errorf("sqlstore: unknown dialect %d", dialect)
+	}
+	return &SQLSessionStore{db, table, dialect}, nil
+}
+
+func (d Dialect) placeholder(n int) string {
+	if d == Postgres {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+func (s *SQLSessionStore) createTableSQL() []string {
+	switch s.dialect {
+	case Postgres:
+		return []string{
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (session_key VARCHAR(255) PRIMARY KEY, data BYTEA NOT NULL, expiry BIGINT NOT NULL)", s.table),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_expiry_idx ON %s (expiry)", s.table, s.table),
+		}
+	case MySQL:
+		// MySQL has no CREATE INDEX IF NOT EXISTS, so the index is declared
+		// with the table.
+		return []string{
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (session_key VARCHAR(255) PRIMARY KEY, data LONGBLOB NOT NULL, expiry BIGINT NOT NULL, INDEX %s_expiry_idx (expiry))", s.table, s.table),
+		}
+	default:
+		return []string{
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (session_key TEXT PRIMARY KEY, data BLOB NOT NULL, expiry INTEGER NOT NULL)", s.table),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_expiry_idx ON %s (expiry)", s.table, s.table),
+		}
+	}
+}
+
+func (s *SQLSessionStore) upsertSQL() string {
+	p := s.dialect.placeholder
+	insert := fmt.Sprintf("INSERT INTO %s (session_key, data, expiry) VALUES (%s, %s, %s)", s.table, p(1), p(2), p(3))
+	if s.dialect == MySQL {
+		return insert + " ON DUPLICATE KEY UPDATE data = VALUES(data), expiry = VALUES(expiry)"
+	}
+	return insert + " ON CONFLICT (session_key) DO UPDATE SET data = excluded.data, expiry = excluded.expiry"
+}
+
+// CreateTable creates the session table and its expiry index if they do not
+// already exist.
+func (s *SQLSessionStore) CreateTable(ctx context.Context) error {
+	for _, stmt := range s.createTableSQL() {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLSessionStore) FindEntry(key string) (*SessionEntry, bool, error) {
+	return s.FindEntryContext(context.Background(), key)
+}
+
+func (s *SQLSessionStore) FindEntryContext(ctx context.Context, key string) (*SessionEntry, bool, error) {
+	var data []byte
+	var expiry int64
+	query := fmt.Sprintf("SELECT data, expiry FROM %s WHERE session_key = %s", s.table, s.dialect.placeholder(1))
+	err := s.db.QueryRowContext(ctx, query, key).Scan(&data, &expiry)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return &SessionEntry{Data: data, SessionExpiry: time.Unix(0, expiry)}, true, nil
+}
+
+func (s *SQLSessionStore) AddEntry(key string, entry *SessionEntry) error {
+	return s.AddEntryContext(context.Background(), key, entry)
+}
+
+func (s *SQLSessionStore) AddEntryContext(ctx context.Context, key string, entry *SessionEntry) error {
+	_, err := s.db.ExecContext(ctx, s.upsertSQL(), key, entry.Data, entry.SessionExpiry.UnixNano())
+	return err
+}
+
+func (s *SQLSessionStore) DeleteEntry(key string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE session_key = %s", s.table, s.dialect.placeholder(1))
+	_, err := s.db.ExecContext(context.Background(), query, key)
+	return err
+}
+
+// TouchEntry updates the expiry of an unexpired row, leaving the data
+// untouched.
+func (s *SQLSessionStore) TouchEntry(key string, expiry time.Time) (bool, error) {
+	p := s.dialect.placeholder
+	query := fmt.Sprintf("UPDATE %s SET expiry = %s WHERE session_key = %s AND expiry >= %s", s.table, p(1), p(2), p(3))
+	res, err := s.db.ExecContext(context.Background(), query, expiry.UnixNano(), key, time.Now().UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// DeleteExpired removes all expired entries and returns how many were removed.
+func (s *SQLSessionStore) DeleteExpired(ctx context.Context) (int64, error) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE expiry < %s", s.table, s.dialect.placeholder(1))
+	res, err := s.db.ExecContext(ctx, query, time.Now().UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,281 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	. "github.com/timob/httpsession/store"
+	"github.com/timob/httpsession/store/storetest"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDriver is a database/sql driver that keeps each database in memory. It
+// only accepts the exact statements listed in dialectSQL for the dialect of
+// the database, so a change to the generated SQL must be checked here. Like
+// lib/pq it rejects a nil data value, which the NOT NULL column would.
+type fakeDriver struct {
+	dbs map[string]*fakeDB
+	sync.Mutex
+}
+
+// fakeSQL is the SQL SQLSessionStore is expected to issue for a table named
+// sessions.
+type fakeSQL struct {
+	create                                     []string
+	upsert, find, delete, touch, deleteExpired string
+}
+
+var dialectSQL = map[Dialect]fakeSQL{
+	SQLite: {
+		create: []string{
+			"CREATE TABLE IF NOT EXISTS sessions (session_key TEXT PRIMARY KEY, data BLOB NOT NULL, expiry INTEGER NOT NULL)",
+			"CREATE INDEX IF NOT EXISTS sessions_expiry_idx ON sessions (expiry)",
+		},
+		upsert:        "INSERT INTO sessions (session_key, data, expiry) VALUES (?, ?, ?) ON CONFLICT (session_key) DO UPDATE SET data = excluded.data, expiry = excluded.expiry",
+		find:          "SELECT data, expiry FROM sessions WHERE session_key = ?",
+		delete:        "DELETE FROM sessions WHERE session_key = ?",
+		touch:         "UPDATE sessions SET expiry = ? WHERE session_key = ? AND expiry >= ?",
+		deleteExpired: "DELETE FROM sessions WHERE expiry < ?",
+	},
+	Postgres: {
+		create: []string{
+			"CREATE TABLE IF NOT EXISTS sessions (session_key VARCHAR(255) PRIMARY KEY, data BYTEA NOT NULL, expiry BIGINT NOT NULL)",
+			"CREATE INDEX IF NOT EXISTS sessions_expiry_idx ON sessions (expiry)",
+		},
+		upsert:        "INSERT INTO sessions (session_key, data, expiry) VALUES ($1, $2, $3) ON CONFLICT (session_key) DO UPDATE SET data = excluded.data, expiry = excluded.expiry",
+		find:          "SELECT data, expiry FROM sessions WHERE session_key = $1",
+		delete:        "DELETE FROM sessions WHERE session_key = $1",
+		touch:         "UPDATE sessions SET expiry = $1 WHERE session_key = $2 AND expiry >= $3",
+		deleteExpired: "DELETE FROM sessions WHERE expiry < $1",
+	},
+	MySQL: {
+		create: []string{
+			"CREATE TABLE IF NOT EXISTS sessions (session_key VARCHAR(255) PRIMARY KEY, data LONGBLOB NOT NULL, expiry BIGINT NOT NULL, INDEX sessions_expiry_idx (expiry))",
+		},
+		upsert:        "INSERT INTO sessions (session_key, data, expiry) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data), expiry = VALUES(expiry)",
+		find:          "SELECT data, expiry FROM sessions WHERE session_key = ?",
+		delete:        "DELETE FROM sessions WHERE session_key = ?",
+		touch:         "UPDATE sessions SET expiry = ? WHERE session_key = ? AND expiry >= ?",
+		deleteExpired: "DELETE FROM sessions WHERE expiry < ?",
+	},
+}
+
+type fakeRow struct {
+	data   []byte
+	expiry int64
+}
+
+type fakeDB struct {
+	sql     fakeSQL
+	rows    map[string]fakeRow
+	created int
+	sync.Mutex
+}
+
+var driverInstance = &fakeDriver{dbs: make(map[string]*fakeDB)}
+
+func init() {
+	sql.Register("sqlstorefake", driverInstance)
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	d.Lock()
+	defer d.Unlock()
+	db, ok := d.dbs[name]
+	if !ok {
+		return nil, fmt.Errorf("fake: no database %q", name)
+	}
+	return &fakeConn{db}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c.db, query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fake: transactions not supported")
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.Lock()
+	defer s.db.Unlock()
+	rows, q := s.db.rows, s.db.sql
+	switch s.query {
+	case q.upsert:
+		data, _ := args[1].([]byte)
+		if data == nil {
+			return nil, errors.New("fake: null value in column data violates not-null constraint")
+		}
+		rows[args[0].(string)] = fakeRow{append([]byte(nil), data...), args[2].(int64)}
+		return driver.RowsAffected(1), nil
+	case q.touch:
+		key := args[1].(string)
+		row, ok := rows[key]
+		if !ok || row.expiry < args[2].(int64) {
+			return driver.RowsAffected(0), nil
+		}
+		row.expiry = args[0].(int64)
+		rows[key] = row
+		return driver.RowsAffected(1), nil
+	case q.delete:
+		key := args[0].(string)
+		if _, ok := rows[key]; !ok {
+			return driver.RowsAffected(0), nil
+		}
+		delete(rows, key)
+		return driver.RowsAffected(1), nil
+	case q.deleteExpired:
+		var n int64
+		for k, row := range rows {
+			if row.expiry < args[0].(int64) {
+				delete(rows, k)
+				n++
+			}
+		}
+		return driver.RowsAffected(n), nil
+	}
+	for _, create := range q.create {
+		if s.query == create {
+			s.db.created++
+			return driver.RowsAffected(0), nil
+		}
+	}
+	return nil, fmt.Errorf("fake: unexpected statement %q", s.query)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.Lock()
+	defer s.db.Unlock()
+	if s.query != s.db.sql.find {
+		return nil, fmt.Errorf("fake: unexpected query %q", s.query)
+	}
+	r := &fakeRows{}
+	if row, ok := s.db.rows[args[0].(string)]; ok {
+		r.rows = append(r.rows, row)
+	}
+	return r, nil
+}
+
+type fakeRows struct {
+	rows []fakeRow
+}
+
+func (r *fakeRows) Columns() []string { return []string{"data", "expiry"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	dest[0], dest[1] = append([]byte{}, r.rows[0].data...), r.rows[0].expiry
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var dialectNames = map[Dialect]string{SQLite: "SQLite", Postgres: "Postgres", MySQL: "MySQL"}
+
+func newStoreFactory(dialect Dialect) storetest.Factory {
+	return func(t testing.TB) SessionEntryStore {
+		name := t.Name()
+		driverInstance.Lock()
+		driverInstance.dbs[name] = &fakeDB{sql: dialectSQL[dialect], rows: make(map[string]fakeRow)}
+		driverInstance.Unlock()
+		db, err := sql.Open("sqlstorefake", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			db.Close()
+			driverInstance.Lock()
+			delete(driverInstance.dbs, name)
+			driverInstance.Unlock()
+		})
+		s, err := NewSQLSessionStore(db, "sessions", dialect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.CreateTable(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+}
+
+var newStore = newStoreFactory(Postgres)
+
+func TestConformance(t *testing.T) {
+	for dialect, name := range dialectNames {
+		t.Run(name, func(t *testing.T) {
+			storetest.RunConformance(t, newStoreFactory(dialect))
+		})
+	}
+}
+
+func TestCreateTable(t *testing.T) {
+	for dialect, name := range dialectNames {
+		t.Run(name, func(t *testing.T) {
+			newStoreFactory(dialect)(t)
+			driverInstance.Lock()
+			db := driverInstance.dbs[t.Name()]
+			driverInstance.Unlock()
+			if db.created != len(dialectSQL[dialect].create) {
+				t.Fatalf("expected %d CREATE statements, got %d", len(dialectSQL[dialect].create), db.created)
+			}
+		})
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	s := newStore(t).(*SQLSessionStore)
+	s.AddEntry("old", &SessionEntry{Data: []byte("x"), SessionExpiry: time.Now().Add(-time.Minute)})
+	s.AddEntry("new", &SessionEntry{Data: []byte("x"), SessionExpiry: time.Now().Add(time.Minute)})
+	if n, err := s.DeleteExpired(context.Background()); err != nil || n != 1 {
+		t.Fatalf("DeleteExpired: %d %v", n, err)
+	}
+	if _, ok, _ := s.FindEntry("old"); ok {
+		t.Fatal("expected expired entry to be removed")
+	}
+	if _, ok, _ := s.FindEntry("new"); !ok {
+		t.Fatal("expected unexpired entry to be kept")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s := newStore(t)
+	s.AddEntry("a", &SessionEntry{Data: []byte("x"), SessionExpiry: time.Now().Add(time.Minute)})
+	// with DeleteEntry, store.Delete doesn't write a nil data value
+	if err := Delete(s, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.FindEntry("a"); ok {
+		t.Fatal("expected entry to be deleted")
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	if _, err := NewSQLSessionStore(nil, "bad name", SQLite); err == nil {
+		t.Fatal("expected invalid table name to be rejected")
+	}
+	if _, err := NewSQLSessionStore(nil, "sessions", Dialect(9)); err == nil {
+		t.Fatal("expected unknown dialect to be rejected")
+	}
+}
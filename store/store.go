@@ -1,6 +1,8 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"time"
 )
 
@@ -9,7 +11,115 @@ type SessionEntryStore interface {
 	AddEntry(key string, entry *SessionEntry) error
 }
 
+// ContextSessionEntryStore is implemented by stores that can cancel a lookup
+// or write when ctx is done.
+type ContextSessionEntryStore interface {
+	FindEntryContext(ctx context.Context, key string) (entry *SessionEntry, ok bool, err error)
+	AddEntryContext(ctx context.Context, key string, entry *SessionEntry) error
+}
+
+// WithContext returns s if it implements ContextSessionEntryStore. Otherwise it
+// returns an adapter that checks ctx before calling s.
+func WithContext(s SessionEntryStore) ContextSessionEntryStore {
+	if c, ok := s.(ContextSessionEntryStore); ok {
+		return c
+	}
+	return contextStore{s}
+}
+
+type contextStore struct {
+	SessionEntryStore
+}
+
+func (c contextStore) FindEntryContext(ctx context.Context, key string) (*SessionEntry, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	return c.FindEntry(key)
+}
+
+func (c contextStore) AddEntryContext(ctx context.Context, key string, entry *SessionEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.AddEntry(key, entry)
+}
+
 type SessionEntry struct {
 	Data          []byte
 	SessionExpiry time.Time
+	// Version is set by stores that implement CASStore. It changes every
+	// time the entry is written, and AddEntry sets it on the given entry.
+	Version uint64
+}
+
+// CASStore is implemented by stores that can write an entry only if it has
+// not been written since it was read.
+type CASStore interface {
+	// CompareAndSwapEntry writes entry if the stored entry has the given
+	// version, with 0 meaning there is no entry. On success entry.Version is
+	// set to the new version. ok is false if the versions did not match.
+	// Decorators that wrap a store without CASStore return ErrNotSupported.
+	CompareAndSwapEntry(key string, version uint64, entry *SessionEntry) (ok bool, err error)
+}
+
+// Deleter is implemented by stores that can remove an entry. Deleting a
+// missing key is not an error.
+type Deleter interface {
+	DeleteEntry(key string) error
+}
+
+// Toucher is implemented by stores that can change the expiry of an entry
+// without rewriting its data. ok is false if there is no entry for key.
+type Toucher interface {
+	TouchEntry(key string, expiry time.Time) (ok bool, err error)
+}
+
+// Iterator is implemented by stores that can walk their entries. Iteration
+// stops when fn returns false.
+type Iterator interface {
+	IterateEntries(fn func(key string, entry *SessionEntry) bool) error
+}
+
+// Locker is implemented by stores that can lock a key for one holder at a
+// time. Locks are leases, so a lock that is never released expires.
+// Decorators that wrap a store without Locker return ErrNotSupported.
+type Locker interface {
+	// LockEntry waits until it holds the lock on key or ctx is done. It
+	// returns a token identifying the holder.
+	LockEntry(ctx context.Context, key string, lease time.Duration) (lockToken string, err error)
+	// UnlockEntry releases the lock. It returns ErrLockNotHeld if the lock
+	// expired and was taken by someone else.
+	UnlockEntry(key string, lockToken string) error
+}
+
+var ErrNotSupported = errors.New("store: operation not supported by store")
+
+var ErrLockNotHeld = errors.New("store: lock not held")
+
+// Delete removes the entry for key, using Deleter if s implements it.
+// Otherwise it overwrites the entry with an expired one.
+func Delete(s SessionEntryStore, key string) error {
+	if d, ok := s.(Deleter); ok {
+		return d.DeleteEntry(key)
+	}
+	return s.AddEntry(key, &SessionEntry{SessionExpiry: time.Now()})
+}
+
+// Touch changes the expiry of the entry for key, using Toucher if s
+// implements it. Otherwise ok is false and the caller must rewrite the entry.
+func Touch(s SessionEntryStore, key string, expiry time.Time) (ok bool, err error) {
+	if t, ok := s.(Toucher); ok {
+		return t.TouchEntry(key, expiry)
+	}
+	return false, nil
+}
+
+// Iterate walks the entries of s, returning ErrNotSupported if s doesn't
+// implement Iterator.
+func Iterate(s SessionEntryStore, fn func(key string, entry *SessionEntry) bool) error {
+	if it, ok := s.(Iterator); ok {
+		return it.IterateEntries(fn)
+	}
+	return ErrNotSupported
 }
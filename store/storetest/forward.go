@@ -0,0 +1,141 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"github.com/timob/httpsession/store"
+	"github.com/timob/httpsession/store/mapstore"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Wrapper returns a store that decorates inner, such as an encrypting or
+// caching store.
+type Wrapper func(t testing.TB, inner store.SessionEntryStore) store.SessionEntryStore
+
+// contextStore records the contexts it is called with.
+type contextStore struct {
+	store.SessionEntryStore
+	contexts []context.Context
+	sync.Mutex
+}
+
+func (c *contextStore) record(ctx context.Context) {
+	c.Lock()
+	c.contexts = append(c.contexts, ctx)
+	c.Unlock()
+}
+
+func (c *contextStore) called(ctx context.Context) bool {
+	c.Lock()
+	defer c.Unlock()
+	for _, got := range c.contexts {
+		if got == ctx {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *contextStore) FindEntryContext(ctx context.Context, key string) (*store.SessionEntry, bool, error) {
+	c.record(ctx)
+	return c.FindEntry(key)
+}
+
+func (c *contextStore) AddEntryContext(ctx context.Context, key string, entry *store.SessionEntry) error {
+	c.record(ctx)
+	return c.AddEntry(key, entry)
+}
+
+type ctxKey struct{}
+
+func newInner() *mapstore.MapSessionStore {
+	return mapstore.NewMapSessionStore()
+}
+
+// RunForwarding checks that a store returned by wrap passes contexts through
+// to an inner store.ContextSessionEntryStore, and forwards
+// CompareAndSwapEntry and versions to an inner store.CASStore and locks to an
+// inner store.Locker. The inner stores are mapstore stores.
+func RunForwarding(t *testing.T, wrap Wrapper) {
+	t.Run("Context", func(t *testing.T) {
+		inner := &contextStore{SessionEntryStore: newInner()}
+		s, ok := wrap(t, inner).(store.ContextSessionEntryStore)
+		if !ok {
+			t.Fatal("store does not implement store.ContextSessionEntryStore")
+		}
+		ctx := context.WithValue(context.Background(), ctxKey{}, "add")
+		if err := s.AddEntryContext(ctx, "a", &store.SessionEntry{Data: []byte("a"), SessionExpiry: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		if !inner.called(ctx) {
+			t.Fatal("AddEntryContext did not pass its context to the inner store")
+		}
+		ctx = context.WithValue(context.Background(), ctxKey{}, "find")
+		if _, _, err := s.FindEntryContext(ctx, "missing"); err != nil {
+			t.Fatal(err)
+		}
+		if !inner.called(ctx) {
+			t.Fatal("FindEntryContext did not pass its context to the inner store")
+		}
+	})
+	t.Run("CAS", func(t *testing.T) {
+		inner := newInner()
+		s, ok := wrap(t, inner).(store.CASStore)
+		if !ok {
+			t.Fatal("store does not implement store.CASStore")
+		}
+		find := s.(store.SessionEntryStore).FindEntry
+		expiry := time.Now().Add(time.Hour)
+
+		entry := &store.SessionEntry{Data: []byte("a"), SessionExpiry: expiry}
+		if ok, err := s.CompareAndSwapEntry("a", 0, entry); !ok || err != nil {
+			t.Fatalf("CompareAndSwapEntry: %v %v", ok, err)
+		}
+		found, ok, err := find("a")
+		if !ok || err != nil || found.Version == 0 || found.Version != entry.Version {
+			t.Fatalf("expected FindEntry to return version %d, got %+v %v", entry.Version, found, err)
+		}
+		stale := found.Version
+		if ok, err := s.CompareAndSwapEntry("a", stale, &store.SessionEntry{Data: []byte("b"), SessionExpiry: expiry}); !ok || err != nil {
+			t.Fatalf("CompareAndSwapEntry: %v %v", ok, err)
+		}
+		if ok, err := s.CompareAndSwapEntry("a", stale, &store.SessionEntry{Data: []byte("c"), SessionExpiry: expiry}); ok || err != nil {
+			t.Fatalf("expected stale version to conflict, got %v %v", ok, err)
+		}
+		if found, _, _ := find("a"); string(found.Data) != "b" {
+			t.Fatalf("expected b, got %q", found.Data)
+		}
+
+		hidden := wrap(t, struct{ store.SessionEntryStore }{newInner()}).(store.CASStore)
+		if _, err := hidden.CompareAndSwapEntry("a", 0, &store.SessionEntry{Data: []byte("a"), SessionExpiry: expiry}); !errors.Is(err, store.ErrNotSupported) {
+			t.Fatalf("expected ErrNotSupported without an inner CASStore, got %v", err)
+		}
+	})
+	t.Run("Locker", func(t *testing.T) {
+		inner := newInner()
+		s, ok := wrap(t, inner).(store.Locker)
+		if !ok {
+			t.Fatal("store does not implement store.Locker")
+		}
+		ctx := context.Background()
+		lockToken, err := s.LockEntry(ctx, "a", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		if _, err := inner.LockEntry(short, "a", time.Minute); err == nil {
+			t.Fatal("LockEntry did not lock the inner store")
+		}
+		if err := s.UnlockEntry("a", lockToken); err != nil {
+			t.Fatal(err)
+		}
+
+		hidden := wrap(t, struct{ store.SessionEntryStore }{newInner()}).(store.Locker)
+		if _, err := hidden.LockEntry(ctx, "a", time.Minute); !errors.Is(err, store.ErrNotSupported) {
+			t.Fatalf("expected ErrNotSupported without an inner Locker, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,416 @@
+// Package storetest checks that a store.SessionEntryStore behaves the way the
+// httpsession package expects. Store implementations run it from their tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.RunConformance(t, func(t testing.TB) store.SessionEntryStore {
+//			return mystore.New()
+//		})
+//	}
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/timob/httpsession/store"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Factory returns a new, empty store. Use t.Cleanup to release it.
+type Factory func(t testing.TB) store.SessionEntryStore
+
+// ExpiryTolerance is how far a stored expiry may drift from the one added.
+var ExpiryTolerance = time.Second
+
+// RunConformance runs the conformance tests as subtests of t. Tests for the
+// optional store.Deleter, store.Toucher, store.Iterator, store.CASStore and
+// store.Locker interfaces are run if the store implements them.
+func RunConformance(t *testing.T, factory Factory) {
+	t.Run("RoundTrip", func(t *testing.T) { testRoundTrip(t, factory(t)) })
+	t.Run("Overwrite", func(t *testing.T) { testOverwrite(t, factory(t)) })
+	t.Run("Expiry", func(t *testing.T) { testExpiry(t, factory(t)) })
+	t.Run("Missing", func(t *testing.T) { testMissing(t, factory(t)) })
+	t.Run("ConcurrentWriters", func(t *testing.T) { testConcurrentWriters(t, factory(t)) })
+	t.Run("LargePayload", func(t *testing.T) { testLargePayload(t, factory(t)) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, factory(t)) })
+	t.Run("Touch", func(t *testing.T) { testTouch(t, factory(t)) })
+	t.Run("Iterate", func(t *testing.T) { testIterate(t, factory(t)) })
+	t.Run("CompareAndSwap", func(t *testing.T) { testCompareAndSwap(t, factory(t)) })
+	t.Run("Lock", func(t *testing.T) { testLock(t, factory(t)) })
+}
+
+func add(t testing.TB, s store.SessionEntryStore, key string, data []byte, expiry time.Time) {
+	t.Helper()
+	if err := s.AddEntry(key, &store.SessionEntry{Data: data, SessionExpiry: expiry}); err != nil {
+		t.Fatalf("AddEntry(%q): %v", key, err)
+	}
+}
+
+func find(t testing.TB, s store.SessionEntryStore, key string) *store.SessionEntry {
+	t.Helper()
+	entry, ok, err := s.FindEntry(key)
+	if err != nil {
+		t.Fatalf("FindEntry(%q): %v", key, err)
+	}
+	if !ok {
+		t.Fatalf("FindEntry(%q): entry not found", key)
+	}
+	return entry
+}
+
+func checkExpiry(t testing.TB, key string, got, want time.Time) {
+	t.Helper()
+	if d := got.Sub(want); d > ExpiryTolerance || d < -ExpiryTolerance {
+		t.Fatalf("entry %q: expiry %s, want %s", key, got, want)
+	}
+}
+
+func testRoundTrip(t *testing.T, s store.SessionEntryStore) {
+	expiry := time.Now().Add(time.Hour)
+	values := map[string][]byte{
+		"plain":           []byte(`{"Values":{"a":1}}`),
+		"empty":           {},
+		"binary":          {0, 1, 2, '\r', '\n', 0xff, 0},
+		"base64-url_key=": []byte("key with base64 characters"),
+		"a/../../escape":  []byte("key with path characters"),
+		"unicode é世 key":  []byte("é世"),
+	}
+	for key, data := range values {
+		add(t, s, key, data, expiry)
+	}
+	for key, data := range values {
+		entry := find(t, s, key)
+		if !bytes.Equal(entry.Data, data) {
+			t.Errorf("entry %q: data %q, want %q", key, entry.Data, data)
+		}
+		checkExpiry(t, key, entry.SessionExpiry, expiry)
+	}
+}
+
+func testOverwrite(t *testing.T, s store.SessionEntryStore) {
+	add(t, s, "k", []byte("first value, longer"), time.Now().Add(time.Hour))
+	expiry := time.Now().Add(2 * time.Hour)
+	add(t, s, "k", []byte("second"), expiry)
+	entry := find(t, s, "k")
+	if string(entry.Data) != "second" {
+		t.Fatalf("data %q after overwrite, want %q", entry.Data, "second")
+	}
+	checkExpiry(t, "k", entry.SessionExpiry, expiry)
+}
+
+func testExpiry(t *testing.T, s store.SessionEntryStore) {
+	add(t, s, "expired", []byte("x"), time.Now().Add(-time.Minute))
+	entry, ok, err := s.FindEntry("expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stores may drop expired entries or return them for the caller to check.
+	if ok && time.Now().Before(entry.SessionExpiry) {
+		t.Fatalf("expired entry returned with expiry %s in the future", entry.SessionExpiry)
+	}
+
+	add(t, s, "short", []byte("x"), time.Now().Add(50*time.Millisecond))
+	find(t, s, "short")
+	time.Sleep(100 * time.Millisecond)
+	entry, ok, err = s.FindEntry("short")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok && time.Now().Before(entry.SessionExpiry) {
+		t.Fatal("entry still live after its expiry")
+	}
+}
+
+func testMissing(t *testing.T, s store.SessionEntryStore) {
+	_, ok, err := s.FindEntry("missing")
+	if err != nil {
+		t.Fatalf("FindEntry of missing key: %v", err)
+	}
+	if ok {
+		t.Fatal("FindEntry of missing key reported ok")
+	}
+	_, ok, err = s.FindEntry("")
+	if err != nil || ok {
+		t.Fatalf("FindEntry of empty key: ok %v err %v", ok, err)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, s store.SessionEntryStore) {
+	const writers, writes = 8, 25
+	expiry := time.Now().Add(time.Hour)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			own := fmt.Sprintf("writer-%d", w)
+			for i := 0; i < writes; i++ {
+				data := []byte(fmt.Sprintf("%s-%d", own, i))
+				if err := s.AddEntry(own, &store.SessionEntry{Data: data, SessionExpiry: expiry}); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := s.AddEntry("shared", &store.SessionEntry{Data: data, SessionExpiry: expiry}); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, _, err := s.FindEntry("shared"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	for w := 0; w < writers; w++ {
+		key := fmt.Sprintf("writer-%d", w)
+		entry := find(t, s, key)
+		if want := fmt.Sprintf("%s-%d", key, writes-1); string(entry.Data) != want {
+			t.Errorf("entry %q: data %q, want %q", key, entry.Data, want)
+		}
+	}
+	entry := find(t, s, "shared")
+	var w, i int
+	if n, _ := fmt.Sscanf(string(entry.Data), "writer-%d-%d", &w, &i); n != 2 || i != writes-1 {
+		t.Errorf("shared entry has data %q, want the last write of one writer", entry.Data)
+	}
+}
+
+func testLargePayload(t *testing.T, s store.SessionEntryStore) {
+	data := make([]byte, 1<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	add(t, s, "large", data, time.Now().Add(time.Hour))
+	if entry := find(t, s, "large"); !bytes.Equal(entry.Data, data) {
+		t.Fatalf("large payload of %d bytes came back as %d bytes", len(data), len(entry.Data))
+	}
+}
+
+func testDelete(t *testing.T, s store.SessionEntryStore) {
+	d, ok := s.(store.Deleter)
+	if !ok {
+		t.Skip("store does not implement store.Deleter")
+	}
+	add(t, s, "a", []byte("a"), time.Now().Add(time.Hour))
+	add(t, s, "b", []byte("b"), time.Now().Add(time.Hour))
+	if err := d.DeleteEntry("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.FindEntry("a"); ok {
+		t.Fatal("entry found after DeleteEntry")
+	}
+	find(t, s, "b")
+	if err := d.DeleteEntry("missing"); err != nil {
+		t.Fatalf("DeleteEntry of missing key: %v", err)
+	}
+}
+
+func testTouch(t *testing.T, s store.SessionEntryStore) {
+	toucher, ok := s.(store.Toucher)
+	if !ok {
+		t.Skip("store does not implement store.Toucher")
+	}
+	add(t, s, "a", []byte("data"), time.Now().Add(time.Minute))
+	expiry := time.Now().Add(time.Hour)
+	ok, err := toucher.TouchEntry("a", expiry)
+	if err != nil || !ok {
+		t.Fatalf("TouchEntry: ok %v err %v", ok, err)
+	}
+	entry := find(t, s, "a")
+	if string(entry.Data) != "data" {
+		t.Fatalf("data %q after TouchEntry", entry.Data)
+	}
+	checkExpiry(t, "a", entry.SessionExpiry, expiry)
+
+	ok, err = toucher.TouchEntry("missing", expiry)
+	if err != nil || ok {
+		t.Fatalf("TouchEntry of missing key: ok %v err %v", ok, err)
+	}
+}
+
+func testIterate(t *testing.T, s store.SessionEntryStore) {
+	it, ok := s.(store.Iterator)
+	if !ok {
+		t.Skip("store does not implement store.Iterator")
+	}
+	want := map[string]string{"a": "1", "b": "2", "c": "3"}
+	for k, v := range want {
+		add(t, s, k, []byte(v), time.Now().Add(time.Hour))
+	}
+	got := make(map[string]string)
+	err := it.IterateEntries(func(key string, entry *store.SessionEntry) bool {
+		got[key] = string(entry.Data)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("iteration gave %q for %q, want %q", got[k], k, v)
+		}
+	}
+
+	n := 0
+	it.IterateEntries(func(string, *store.SessionEntry) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Fatalf("iteration continued after fn returned false, %d calls", n)
+	}
+}
+
+func testCompareAndSwap(t *testing.T, s store.SessionEntryStore) {
+	cas, ok := s.(store.CASStore)
+	if !ok {
+		t.Skip("store does not implement store.CASStore")
+	}
+	expiry := time.Now().Add(time.Hour)
+	first := &store.SessionEntry{Data: []byte("1"), SessionExpiry: expiry}
+	ok, err := cas.CompareAndSwapEntry("a", 0, first)
+	if errors.Is(err, store.ErrNotSupported) {
+		t.Skip("store wraps a store that does not implement store.CASStore")
+	}
+	if err != nil || !ok {
+		t.Fatalf("CompareAndSwapEntry of new key: ok %v err %v", ok, err)
+	}
+	if first.Version == 0 {
+		t.Fatal("CompareAndSwapEntry did not set a version")
+	}
+	if entry := find(t, s, "a"); entry.Version != first.Version {
+		t.Fatalf("FindEntry version %d, want %d", entry.Version, first.Version)
+	}
+
+	if ok, _ := cas.CompareAndSwapEntry("a", 0, &store.SessionEntry{Data: []byte("x"), SessionExpiry: expiry}); ok {
+		t.Fatal("CompareAndSwapEntry with version 0 replaced an existing entry")
+	}
+	second := &store.SessionEntry{Data: []byte("2"), SessionExpiry: expiry}
+	if ok, err := cas.CompareAndSwapEntry("a", first.Version, second); err != nil || !ok {
+		t.Fatalf("CompareAndSwapEntry with current version: ok %v err %v", ok, err)
+	}
+	if ok, _ := cas.CompareAndSwapEntry("a", first.Version, &store.SessionEntry{Data: []byte("x"), SessionExpiry: expiry}); ok {
+		t.Fatal("CompareAndSwapEntry with stale version succeeded")
+	}
+
+	add(t, s, "a", []byte("3"), expiry)
+	if entry := find(t, s, "a"); string(entry.Data) != "3" || entry.Version == second.Version {
+		t.Fatalf("AddEntry must change the version, got data %q version %d", entry.Data, entry.Version)
+	}
+}
+
+func testLock(t *testing.T, s store.SessionEntryStore) {
+	locker, ok := s.(store.Locker)
+	if !ok {
+		t.Skip("store does not implement store.Locker")
+	}
+	ctx := context.Background()
+	first, err := locker.LockEntry(ctx, "a", time.Minute)
+	if errors.Is(err, store.ErrNotSupported) {
+		t.Skip("backing store does not implement store.Locker")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = locker.LockEntry(ctx, "b", time.Minute); err != nil {
+		t.Fatalf("lock on a blocked lock on b: %v", err)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = locker.LockEntry(short, "a", time.Minute); err == nil {
+		t.Fatal("LockEntry took a held lock")
+	}
+
+	acquired := make(chan error)
+	go func() {
+		lockToken, err := locker.LockEntry(ctx, "a", time.Minute)
+		if err == nil {
+			err = locker.UnlockEntry("a", lockToken)
+		}
+		acquired <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err = locker.UnlockEntry("a", first); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting LockEntry not woken by UnlockEntry")
+	}
+	if err = locker.UnlockEntry("a", first); err != store.ErrLockNotHeld {
+		t.Fatalf("second UnlockEntry: got %v, want store.ErrLockNotHeld", err)
+	}
+
+	expiring, err := locker.LockEntry(ctx, "c", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err = locker.LockEntry(wait, "c", time.Minute); err != nil {
+		t.Fatalf("expired lease not taken over: %v", err)
+	}
+	if err = locker.UnlockEntry("c", expiring); err != store.ErrLockNotHeld {
+		t.Fatalf("UnlockEntry of expired lease: got %v, want store.ErrLockNotHeld", err)
+	}
+}
+
+// RunBenchmarks runs the benchmark suite as sub-benchmarks of b.
+func RunBenchmarks(b *testing.B, factory Factory) {
+	for _, size := range []int{256, 16 << 10} {
+		data := make([]byte, size)
+		expiry := time.Now().Add(time.Hour)
+		b.Run(fmt.Sprintf("Add/%d", size), func(b *testing.B) {
+			s := factory(b)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				add(b, s, fmt.Sprintf("key-%d", i%1000), data, expiry)
+			}
+		})
+		b.Run(fmt.Sprintf("Find/%d", size), func(b *testing.B) {
+			s := factory(b)
+			for i := 0; i < 1000; i++ {
+				add(b, s, fmt.Sprintf("key-%d", i), data, expiry)
+			}
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				find(b, s, fmt.Sprintf("key-%d", i%1000))
+			}
+		})
+		b.Run(fmt.Sprintf("Parallel/%d", size), func(b *testing.B) {
+			s := factory(b)
+			for i := 0; i < 1000; i++ {
+				add(b, s, fmt.Sprintf("key-%d", i), data, expiry)
+			}
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := fmt.Sprintf("key-%d", i%1000)
+					if i%10 == 0 {
+						s.AddEntry(key, &store.SessionEntry{Data: data, SessionExpiry: expiry})
+					} else {
+						s.FindEntry(key)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
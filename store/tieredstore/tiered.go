@@ -0,0 +1,380 @@
+// Package tieredstore puts a bounded in-process cache in front of a slower
+// store.SessionEntryStore.
+package tieredstore
+
+import (
+	"context"
+	"encoding/binary"
+	. "github.com/timob/httpsession/store"
+	"github.com/timob/httpsession/store/mapstore"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+type Mode int
+
+const (
+	// WriteThrough writes to the remote store before AddEntry returns.
+	WriteThrough Mode = iota
+	// WriteBehind returns once the local cache is updated and writes to the
+	// remote store in the background. Writes to the same key are coalesced.
+	WriteBehind
+)
+
+type Options struct {
+	// MaxEntries is the size of the local cache. Defaults to 10000.
+	MaxEntries int
+	Mode       Mode
+	// NegativeTTL caches keys missing from the remote store for this long.
+	// Zero disables negative caching.
+	NegativeTTL time.Duration
+	// OnWrite is called after a key is added, touched or deleted. Multi-instance
+	// deployments use it to tell the other instances to Invalidate the key.
+	OnWrite func(key string)
+	// OnError is called when a background write fails in WriteBehind mode.
+	OnError func(key string, err error)
+	// QueueSize is the number of keys waiting for a background write before
+	// writers block. Defaults to 1024.
+	QueueSize int
+}
+
+type pendingOp struct {
+	entry *SessionEntry // nil for a delete
+}
+
+type TieredSessionStore struct {
+	remote    SessionEntryStore
+	remoteCtx ContextSessionEntryStore
+	local     *mapstore.MapSessionStore
+	opts      Options
+
+	missing map[string]time.Time
+	pending map[string]*pendingOp
+	// gens counts writes per hash of key, so that a remote read is only
+	// cached if the key wasn't written while it ran.
+	gens   [256]uint64
+	queue  chan string
+	wg     sync.WaitGroup
+	closed chan struct{}
+	once   sync.Once
+	*sync.Mutex
+}
+
+func NewTieredSessionStore(remote SessionEntryStore, opts Options) *TieredSessionStore {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 10000
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1024
+	}
+	t := &TieredSessionStore{
+		remote:    remote,
+		remoteCtx: WithContext(remote),
+		local:     mapstore.NewMapSessionStoreWithOptions(mapstore.Options{MaxEntries: opts.MaxEntries}),
+		opts:      opts,
+		missing:   make(map[string]time.Time),
+		pending:   make(map[string]*pendingOp),
+		closed:    make(chan struct{}),
+		Mutex:     &sync.Mutex{},
+	}
+	if opts.Mode == WriteBehind {
+		t.queue = make(chan string, opts.QueueSize)
+		go t.writer()
+	}
+	return t
+}
+
+func (t *TieredSessionStore) FindEntry(key string) (*SessionEntry, bool, error) {
+	return t.FindEntryContext(context.Background(), key)
+}
+
+// FindEntryContext uses ctx for the remote lookup on a cache miss.
+func (t *TieredSessionStore) FindEntryContext(ctx context.Context, key string) (*SessionEntry, bool, error) {
+	if entry, ok := t.cached(key); ok {
+		return entry, true, nil
+	}
+
+	t.Lock()
+	if op, ok := t.pending[key]; ok {
+		t.Unlock()
+		if op.entry == nil {
+			return nil, false, nil
+		}
+		return copyEntry(op.entry), true, nil
+	}
+	if until, ok := t.missing[key]; ok {
+		if time.Now().Before(until) {
+			t.Unlock()
+			return nil, false, nil
+		}
+		delete(t.missing, key)
+	}
+	gen := *t.gen(key)
+	t.Unlock()
+
+	entry, ok, err := t.remoteCtx.FindEntryContext(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if *t.gen(key) != gen {
+		// written since the read started, the result may be stale
+		return entry, ok, nil
+	}
+	if !ok {
+		if t.opts.NegativeTTL > 0 {
+			if len(t.missing) >= t.opts.MaxEntries {
+				t.missing = make(map[string]time.Time)
+			}
+			t.missing[key] = time.Now().Add(t.opts.NegativeTTL)
+		}
+		return nil, false, nil
+	}
+	t.cache(key, entry)
+	return entry, true, nil
+}
+
+func (t *TieredSessionStore) AddEntry(key string, entry *SessionEntry) error {
+	return t.AddEntryContext(context.Background(), key, entry)
+}
+
+// AddEntryContext uses ctx for the remote write in WriteThrough mode. In
+// WriteBehind mode ctx is only checked before the write is queued.
+func (t *TieredSessionStore) AddEntryContext(ctx context.Context, key string, entry *SessionEntry) error {
+	if t.opts.Mode == WriteBehind {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c := copyEntry(entry)
+		t.bump(key)
+		t.cache(key, c)
+		t.enqueue(key, &pendingOp{entry: c})
+	} else {
+		err := t.remoteCtx.AddEntryContext(ctx, key, entry)
+		t.bump(key)
+		if err != nil {
+			t.local.DeleteEntry(key)
+			return err
+		}
+		t.cache(key, entry)
+	}
+	t.written(key)
+	return nil
+}
+
+// CompareAndSwapEntry writes through to the remote store. It returns
+// ErrNotSupported in WriteBehind mode, or if the remote store is not a
+// CASStore.
+func (t *TieredSessionStore) CompareAndSwapEntry(key string, version uint64, entry *SessionEntry) (bool, error) {
+	cas, ok := t.remote.(CASStore)
+	if !ok || t.opts.Mode == WriteBehind {
+		return false, ErrNotSupported
+	}
+	ok, err := cas.CompareAndSwapEntry(key, version, entry)
+	t.bump(key)
+	if err != nil || !ok {
+		// the cached entry may be stale
+		t.local.DeleteEntry(key)
+		return ok, err
+	}
+	t.cache(key, entry)
+	t.written(key)
+	return true, nil
+}
+
+// LockEntry locks key in the remote store, so that the lock is shared with
+// other instances. The local entry is dropped once the lock is held, since
+// the previous holder may have written it from another instance. It returns
+// ErrNotSupported if the remote store is not a Locker.
+func (t *TieredSessionStore) LockEntry(ctx context.Context, key string, lease time.Duration) (string, error) {
+	locker, ok := t.remote.(Locker)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	lockToken, err := locker.LockEntry(ctx, key, lease)
+	if err != nil {
+		return "", err
+	}
+	t.Invalidate(key)
+	return lockToken, nil
+}
+
+func (t *TieredSessionStore) UnlockEntry(key string, lockToken string) error {
+	locker, ok := t.remote.(Locker)
+	if !ok {
+		return ErrNotSupported
+	}
+	return locker.UnlockEntry(key, lockToken)
+}
+
+func (t *TieredSessionStore) DeleteEntry(key string) error {
+	if t.opts.Mode == WriteBehind {
+		t.bump(key)
+		t.local.DeleteEntry(key)
+		t.enqueue(key, &pendingOp{})
+	} else {
+		err := Delete(t.remote, key)
+		t.bump(key)
+		t.local.DeleteEntry(key)
+		if err != nil {
+			return err
+		}
+	}
+	t.written(key)
+	return nil
+}
+
+func (t *TieredSessionStore) TouchEntry(key string, expiry time.Time) (bool, error) {
+	t.Lock()
+	if op, ok := t.pending[key]; ok && op.entry != nil {
+		touched := *op.entry
+		touched.SessionExpiry = expiry
+		t.pending[key] = &pendingOp{entry: &touched}
+		*t.gen(key)++
+		t.Unlock()
+		t.local.TouchEntry(key, expiry)
+		t.written(key)
+		return true, nil
+	}
+	t.Unlock()
+
+	ok, err := Touch(t.remote, key, expiry)
+	if err != nil || !ok {
+		// the caller will rewrite the entry
+		return ok, err
+	}
+	t.bump(key)
+	t.local.TouchEntry(key, expiry)
+	t.written(key)
+	return true, nil
+}
+
+func (t *TieredSessionStore) IterateEntries(fn func(key string, entry *SessionEntry) bool) error {
+	t.Flush()
+	return Iterate(t.remote, fn)
+}
+
+// Invalidate drops key from the local cache, so the next FindEntry reads it
+// from the remote store. Pending background writes are not affected.
+func (t *TieredSessionStore) Invalidate(key string) {
+	t.bump(key)
+	t.local.DeleteEntry(key)
+}
+
+// Flush waits for pending background writes to finish.
+func (t *TieredSessionStore) Flush() {
+	t.wg.Wait()
+}
+
+// Close flushes pending writes and stops the background writer. The store
+// must not be written to after Close.
+func (t *TieredSessionStore) Close() error {
+	t.once.Do(func() {
+		t.Flush()
+		close(t.closed)
+	})
+	return nil
+}
+
+// gen returns the write generation of key. t must be locked.
+func (t *TieredSessionStore) gen(key string) *uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &t.gens[h.Sum32()%uint32(len(t.gens))]
+}
+
+// bump records a write to key. It must be called after the remote write and
+// before the local cache is updated, so that a FindEntry racing with the
+// write doesn't cache what it read.
+func (t *TieredSessionStore) bump(key string) {
+	t.Lock()
+	*t.gen(key)++
+	delete(t.missing, key)
+	t.Unlock()
+}
+
+func (t *TieredSessionStore) written(key string) {
+	if t.opts.OnWrite != nil {
+		t.opts.OnWrite(key)
+	}
+}
+
+func (t *TieredSessionStore) enqueue(key string, op *pendingOp) {
+	t.Lock()
+	_, queued := t.pending[key]
+	t.pending[key] = op
+	if !queued {
+		t.wg.Add(1)
+	}
+	t.Unlock()
+	if !queued {
+		t.queue <- key
+	}
+}
+
+func (t *TieredSessionStore) writer() {
+	for {
+		select {
+		case key := <-t.queue:
+			t.write(key)
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+// write applies the pending op for key, repeating while newer ops arrive so
+// that the remote store ends up with the last one.
+func (t *TieredSessionStore) write(key string) {
+	defer t.wg.Done()
+	t.Lock()
+	op := t.pending[key]
+	t.Unlock()
+	for {
+		var err error
+		if op.entry == nil {
+			err = Delete(t.remote, key)
+		} else {
+			err = t.remote.AddEntry(key, op.entry)
+		}
+		if err != nil && t.opts.OnError != nil {
+			t.opts.OnError(key, err)
+		}
+
+		t.Lock()
+		if next := t.pending[key]; next != op {
+			op = next
+			t.Unlock()
+			continue
+		}
+		delete(t.pending, key)
+		t.Unlock()
+		return
+	}
+}
+
+// cache adds entry to the local cache. The local store assigns versions of
+// its own, so the remote version is kept in front of the data.
+func (t *TieredSessionStore) cache(key string, entry *SessionEntry) {
+	data := make([]byte, 8+len(entry.Data))
+	binary.BigEndian.PutUint64(data, entry.Version)
+	copy(data[8:], entry.Data)
+	t.local.AddEntry(key, &SessionEntry{Data: data, SessionExpiry: entry.SessionExpiry})
+}
+
+func (t *TieredSessionStore) cached(key string) (*SessionEntry, bool) {
+	entry, ok, _ := t.local.FindEntry(key)
+	if !ok {
+		return nil, false
+	}
+	return &SessionEntry{Data: entry.Data[8:], SessionExpiry: entry.SessionExpiry, Version: binary.BigEndian.Uint64(entry.Data)}, true
+}
+
+func copyEntry(e *SessionEntry) *SessionEntry {
+	c := *e
+	c.Data = append([]byte(nil), e.Data...)
+	return &c
+}
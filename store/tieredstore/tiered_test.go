@@ -0,0 +1,171 @@
+package tieredstore
+
+import (
+	. "github.com/timob/httpsession/store"
+	"github.com/timob/httpsession/store/mapstore"
+	"github.com/timob/httpsession/store/storetest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStore counts calls to the remote store and can block writes.
+// afterFind, if set, is called once after the next FindEntry has read the
+// entry.
+type countingStore struct {
+	*mapstore.MapSessionStore
+	finds, adds int
+	block       chan struct{}
+	afterFind   func()
+	*sync.Mutex
+}
+
+func newCountingStore() *countingStore {
+	return &countingStore{MapSessionStore: mapstore.NewMapSessionStore(), Mutex: &sync.Mutex{}}
+}
+
+func (c *countingStore) FindEntry(key string) (*SessionEntry, bool, error) {
+	c.Lock()
+	c.finds++
+	afterFind := c.afterFind
+	c.afterFind = nil
+	c.Unlock()
+	entry, ok, err := c.MapSessionStore.FindEntry(key)
+	if afterFind != nil {
+		afterFind()
+	}
+	return entry, ok, err
+}
+
+func (c *countingStore) AddEntry(key string, entry *SessionEntry) error {
+	if c.block != nil {
+		<-c.block
+	}
+	c.Lock()
+	c.adds++
+	c.Unlock()
+	return c.MapSessionStore.AddEntry(key, entry)
+}
+
+func TestConformance(t *testing.T) {
+	for name, mode := range map[string]Mode{"WriteThrough": WriteThrough, "WriteBehind": WriteBehind} {
+		t.Run(name, func(t *testing.T) {
+			storetest.RunConformance(t, func(t testing.TB) SessionEntryStore {
+				s := NewTieredSessionStore(mapstore.NewMapSessionStore(), Options{Mode: mode})
+				t.Cleanup(func() { s.Close() })
+				return s
+			})
+		})
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	remote := newCountingStore()
+	var written []string
+	s := NewTieredSessionStore(remote, Options{NegativeTTL: time.Minute, OnWrite: func(key string) {
+		written = append(written, key)
+	}})
+	expiry := time.Now().Add(time.Minute)
+
+	s.FindEntry("a")
+	s.FindEntry("a")
+	if remote.finds != 1 {
+		t.Fatalf("expected missing key to be cached, remote saw %d finds", remote.finds)
+	}
+
+	s.AddEntry("a", &SessionEntry{Data: []byte("1"), SessionExpiry: expiry})
+	if remote.adds != 1 {
+		t.Fatal("expected write through to remote")
+	}
+	if entry, ok, _ := s.FindEntry("a"); !ok || string(entry.Data) != "1" || remote.finds != 1 {
+		t.Fatal("expected added entry to be served from the local cache")
+	}
+	if len(written) != 1 || written[0] != "a" {
+		t.Fatalf("expected OnWrite for a, got %v", written)
+	}
+
+	// another instance changes the entry and tells us to invalidate it
+	remote.MapSessionStore.AddEntry("a", &SessionEntry{Data: []byte("2"), SessionExpiry: expiry})
+	s.Invalidate("a")
+	if entry, _, _ := s.FindEntry("a"); string(entry.Data) != "2" {
+		t.Fatal("expected invalidated key to be read from remote")
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	remote := newCountingStore()
+	remote.block = make(chan struct{})
+	s := NewTieredSessionStore(remote, Options{Mode: WriteBehind, MaxEntries: 1})
+	defer s.Close()
+	expiry := time.Now().Add(time.Minute)
+
+	for _, v := range []string{"1", "2", "3"} {
+		s.AddEntry("a", &SessionEntry{Data: []byte(v), SessionExpiry: expiry})
+	}
+	// evict a from the local cache, it must still be served from pending
+	s.AddEntry("b", &SessionEntry{Data: []byte("b"), SessionExpiry: expiry})
+	if entry, ok, _ := s.FindEntry("a"); !ok || string(entry.Data) != "3" {
+		t.Fatal("expected pending write to be visible")
+	}
+
+	close(remote.block)
+	s.Flush()
+	if entry, _, _ := remote.MapSessionStore.FindEntry("a"); string(entry.Data) != "3" {
+		t.Fatalf("expected remote to have last write, got %q", entry.Data)
+	}
+	if remote.adds > 3 {
+		t.Fatalf("expected writes to a to be coalesced, remote saw %d adds", remote.adds)
+	}
+}
+
+func TestFindRacingWrite(t *testing.T) {
+	remote := newCountingStore()
+	s := NewTieredSessionStore(remote, Options{NegativeTTL: time.Minute})
+	expiry := time.Now().Add(time.Minute)
+	remote.MapSessionStore.AddEntry("a", &SessionEntry{Data: []byte("old"), SessionExpiry: expiry})
+
+	// the write lands between the remote read and filling the cache
+	remote.afterFind = func() {
+		s.AddEntry("a", &SessionEntry{Data: []byte("new"), SessionExpiry: expiry})
+	}
+	if entry, _, _ := s.FindEntry("a"); string(entry.Data) != "old" {
+		t.Fatalf("expected racing FindEntry to return what it read, got %q", entry.Data)
+	}
+	if entry, _, _ := s.FindEntry("a"); string(entry.Data) != "new" {
+		t.Fatalf("expected the racing read not to be cached, got %q", entry.Data)
+	}
+
+	remote.afterFind = func() {
+		s.AddEntry("b", &SessionEntry{Data: []byte("new"), SessionExpiry: expiry})
+	}
+	s.FindEntry("b")
+	if _, ok, _ := s.FindEntry("b"); !ok {
+		t.Fatal("expected the racing miss not to be cached")
+	}
+}
+
+func TestMultiInstanceTouch(t *testing.T) {
+	remote := mapstore.NewMapSessionStore()
+	var a, b *TieredSessionStore
+	a = NewTieredSessionStore(remote, Options{OnWrite: func(key string) { b.Invalidate(key) }})
+	b = NewTieredSessionStore(remote, Options{OnWrite: func(key string) { a.Invalidate(key) }})
+
+	a.AddEntry("k", &SessionEntry{Data: []byte("x"), SessionExpiry: time.Now().Add(time.Minute)})
+	b.FindEntry("k")
+
+	expiry := time.Now().Add(time.Hour)
+	if ok, err := a.TouchEntry("k", expiry); !ok || err != nil {
+		t.Fatalf("TouchEntry: %v %v", ok, err)
+	}
+	if entry, _, _ := b.FindEntry("k"); entry.SessionExpiry.Before(expiry.Add(-time.Second)) {
+		t.Fatalf("expected other instance to see the touched expiry, got %v", entry.SessionExpiry)
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	storetest.RunForwarding(t, func(t testing.TB, inner SessionEntryStore) SessionEntryStore {
+		s := NewTieredSessionStore(inner, Options{})
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
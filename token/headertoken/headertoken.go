@@ -0,0 +1,89 @@
+// Package headertoken carries session tokens in HTTP headers, for clients
+// that can't use cookies.
+package headertoken
+
+import (
+	"errors"
+	"github.com/timob/httpsession/token"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HeaderToken reads a token from the request header Name and writes it to the
+// response header ResponseName.
+type HeaderToken struct {
+	Name string
+	// Scheme, if set, comes before the token in the request header, as in
+	// "Authorization: Bearer <token>".
+	Scheme string
+	// ResponseName defaults to Name.
+	ResponseName string
+	Resp         http.ResponseWriter
+	Req          *http.Request
+}
+
+// Headers names the headers used by a header session. The session token is
+// sent as "Authorization: Bearer <token>".
+type Headers struct {
+	// Session is the response header with the session token.
+	Session string
+	// AuthRequest and AuthResponse carry the auth token, which changes as it
+	// is rotated.
+	AuthRequest  string
+	AuthResponse string
+}
+
+var DefaultHeaders = Headers{
+	Session:      "X-Session-Token",
+	AuthRequest:  "X-Session-Auth",
+	AuthResponse: "X-Session-Auth",
+}
+
+// Validate checks that every header is named. An empty Session name would
+// send the session token back in an Authorization response header.
+func (h Headers) Validate() error {
+	if h.Session == "" || h.AuthRequest == "" || h.AuthResponse == "" {
+		return errors.New("headertoken: Session, AuthRequest and AuthResponse must be set")
+	}
+	return nil
+}
+
+// Bearer returns a HeaderToken for "Authorization: Bearer <token>", that is
+// sent back in responseName.
+func Bearer(responseName string, w http.ResponseWriter, r *http.Request) *HeaderToken {
+	return &HeaderToken{Name: "Authorization", Scheme: "Bearer", ResponseName: responseName, Resp: w, Req: r}
+}
+
+func (h *HeaderToken) GetToken() token.Token {
+	val := strings.TrimSpace(h.Req.Header.Get(h.Name))
+	if h.Scheme != "" {
+		scheme, rest, ok := strings.Cut(val, " ")
+		if !ok || !strings.EqualFold(scheme, h.Scheme) {
+			return token.EmptyToken
+		}
+		val = strings.TrimSpace(rest)
+	}
+	if val == "" {
+		return token.EmptyToken
+	}
+	return token.TokenStr(val)
+}
+
+// SetToken sets the response header to t. The client is expected to keep the
+// token for d. The empty token is sent as an empty header, telling the client
+// to forget its token.
+func (h *HeaderToken) SetToken(t token.Token, d time.Duration) {
+	h.Resp.Header().Set(h.responseName(), t.String())
+}
+
+func (h *HeaderToken) Remove() {
+	h.SetToken(token.EmptyToken, 0)
+}
+
+func (h *HeaderToken) responseName() string {
+	if h.ResponseName != "" {
+		return h.ResponseName
+	}
+	return h.Name
+}
@@ -1,11 +1,62 @@
 package sessioncookie
 
 import (
+	"errors"
 	"github.com/timob/httpsession/token"
 	"net/http"
+	"strings"
 	"time"
 )
 
+type SecureMode int
+
+const (
+	// SecureAuto sets Secure when the request came over TLS, directly or
+	// through a proxy that sets X-Forwarded-Proto.
+	SecureAuto SecureMode = iota
+	SecureAlways
+	SecureNever
+)
+
+// Prefix is put in front of cookie names to have browsers enforce cookie
+// attributes, see CookieOptions.Validate.
+type Prefix string
+
+const (
+	PrefixNone Prefix = ""
+	// PrefixSecure cookies must be Secure.
+	PrefixSecure Prefix = "__Secure-"
+	// PrefixHost cookies must be Secure, have Path=/ and no Domain, so they
+	// can't be set by other subdomains.
+	PrefixHost Prefix = "__Host-"
+)
+
+// CookieOptions are the attributes of the cookies set by SessionCookie.
+type CookieOptions struct {
+	// Prefix is added to the cookie name. Cookies without it are still read,
+	// so that existing sessions survive turning it on, and are expired when
+	// the prefixed cookie is set.
+	Prefix Prefix
+	// IgnoreUnprefixed stops cookies without Prefix from being read, once
+	// existing sessions have moved to the prefixed name.
+	IgnoreUnprefixed bool
+	Path             string
+	// Domain is left empty for a host-only cookie.
+	Domain      string
+	Secure      SecureMode
+	SameSite    http.SameSite
+	Partitioned bool
+	HttpOnly    bool
+}
+
+// DefaultCookieOptions are used by SetToken and Remove.
+var DefaultCookieOptions = CookieOptions{
+	Path:     "/",
+	Secure:   SecureAuto,
+	SameSite: http.SameSiteLaxMode,
+	HttpOnly: true,
+}
+
 type SessionCookie struct {
 	Name string
 	Resp http.ResponseWriter
@@ -20,7 +71,35 @@ func (c *SessionCookie) GetToken() token.Token {
 	return token.TokenStr(idCookie.Value)
 }
 
+// GetTokenWithOptions reads the cookie named with the prefix in opts, or the
+// unprefixed cookie if there isn't one and opts.IgnoreUnprefixed is not set.
+func (c *SessionCookie) GetTokenWithOptions(opts CookieOptions) token.Token {
+	if idCookie, err := c.Req.Cookie(string(opts.Prefix) + c.Name); err == nil {
+		return token.TokenStr(idCookie.Value)
+	}
+	if opts.Prefix != PrefixNone && opts.IgnoreUnprefixed {
+		return token.EmptyToken
+	}
+	return c.GetToken()
+}
+
 func (c *SessionCookie) SetToken(t token.Token, d time.Duration) {
+	c.SetTokenWithOptions(t, d, DefaultCookieOptions)
+}
+
+// SetTokenWithOptions sets the cookie named with the prefix in opts. An
+// unprefixed cookie sent with the request is expired, so that the session
+// only has one name.
+func (c *SessionCookie) SetTokenWithOptions(t token.Token, d time.Duration, opts CookieOptions) {
+	c.setCookie(t, d, opts)
+	if opts.Prefix != PrefixNone {
+		if _, err := c.Req.Cookie(c.Name); err == nil {
+			c.setCookie(token.EmptyToken, 0, opts.unprefixed())
+		}
+	}
+}
+
+func (c *SessionCookie) setCookie(t token.Token, d time.Duration, opts CookieOptions) {
 	var val string
 	var maxAge int
 	if !t.IsEmpty() {
@@ -33,12 +112,15 @@ func (c *SessionCookie) SetToken(t token.Token, d time.Duration) {
 	http.SetCookie(
 		c.Resp,
 		&http.Cookie{
-			Name:     c.Name,
-			Value:    val,
-			Path:     "/",
-			Domain:   c.Req.URL.Host,
-			MaxAge:   maxAge,
-			HttpOnly: true,
+			Name:        string(opts.Prefix) + c.Name,
+			Value:       val,
+			Path:        opts.Path,
+			Domain:      opts.Domain,
+			MaxAge:      maxAge,
+			Secure:      opts.secure(c.Req),
+			HttpOnly:    opts.HttpOnly,
+			SameSite:    opts.SameSite,
+			Partitioned: opts.Partitioned,
 		},
 	)
 	return
@@ -47,3 +129,86 @@ func (c *SessionCookie) SetToken(t token.Token, d time.Duration) {
 func (c *SessionCookie) Remove() {
 	c.SetToken(token.EmptyToken, 0)
 }
+
+// RemoveWithOptions removes a cookie set with opts, and the unprefixed cookie
+// it may have replaced. Browsers only replace a cookie with the same path and
+// domain.
+func (c *SessionCookie) RemoveWithOptions(opts CookieOptions) {
+	c.setCookie(token.EmptyToken, 0, opts)
+	if opts.Prefix != PrefixNone {
+		c.setCookie(token.EmptyToken, 0, opts.unprefixed())
+	}
+}
+
+// Validate checks that the options follow the rules for their prefix, and
+// that SameSite=None and Partitioned cookies use SecureAlways, as browsers
+// drop them when they aren't Secure.
+func (o CookieOptions) Validate() error {
+	if (o.SameSite == http.SameSiteNoneMode || o.Partitioned) && o.Secure != SecureAlways {
+		return errors.New("sessioncookie: SameSite=None and Partitioned cookies must use SecureAlways")
+	}
+	switch o.Prefix {
+	case PrefixNone:
+		return nil
+	case PrefixSecure, PrefixHost:
+	default:
+		return errors.New("sessioncookie: unknown cookie prefix " + string(o.Prefix))
+	}
+	if o.Secure == SecureNever {
+		return errors.New("sessioncookie: " + string(o.Prefix) + " cookies must be Secure")
+	}
+	if o.Prefix == PrefixHost && o.Path != "/" {
+		return errors.New("sessioncookie: __Host- cookies must have Path=/")
+	}
+	if o.Prefix == PrefixHost && o.Domain != "" {
+		return errors.New("sessioncookie: __Host- cookies can't have a Domain")
+	}
+	return nil
+}
+
+func (o CookieOptions) unprefixed() CookieOptions {
+	o.Prefix = PrefixNone
+	return o
+}
+
+func (o CookieOptions) secure(r *http.Request) bool {
+	if o.Prefix != PrefixNone {
+		return true
+	}
+	switch o.Secure {
+	case SecureAlways:
+		return true
+	case SecureNever:
+		return false
+	}
+	return IsSecureRequest(r)
+}
+
+// IsSecureRequest reports whether r came over TLS, or was forwarded by a proxy
+// that received it over TLS. X-Forwarded-Proto should only be trusted behind a
+// proxy that sets it.
+func IsSecureRequest(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// Cookie is a SessionCookie that is read and set using Options.
+type Cookie struct {
+	*SessionCookie
+	Options CookieOptions
+}
+
+func (c *Cookie) GetToken() token.Token {
+	return c.SessionCookie.GetTokenWithOptions(c.Options)
+}
+
+func (c *Cookie) SetToken(t token.Token, d time.Duration) {
+	c.SessionCookie.SetTokenWithOptions(t, d, c.Options)
+}
+
+func (c *Cookie) Remove() {
+	c.SessionCookie.RemoveWithOptions(c.Options)
+}
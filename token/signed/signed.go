@@ -0,0 +1,77 @@
+// Package signed appends an HMAC to session id tokens, so that forged or
+// garbage ids are rejected before they reach the session store.
+package signed
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/timob/httpsession/token"
+	"strings"
+)
+
+// separator can't appear in ids, which are URL safe base64.
+const separator = "."
+
+// MinKeySize is the shortest key accepted by NewSigner.
+const MinKeySize = 32
+
+// Signer signs tokens as
+//
+//	id "." base64(HMAC-SHA256(key, id))
+type Signer struct {
+	keys [][]byte
+}
+
+// NewSigner signs tokens with current. Tokens signed with any of old are
+// still accepted, so current can be rotated without ending sessions.
+func NewSigner(current []byte, old ...[]byte) (*Signer, error) {
+	s := &Signer{}
+	for _, k := range append([][]byte{current}, old...) {
+		if len(k) < MinKeySize {
+			return nil, errors.New("signed: key shorter than 32 bytes")
+		}
+		s.keys = append(s.keys, append([]byte(nil), k...))
+	}
+	return s, nil
+}
+
+func mac(key []byte, id string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(id))
+	return h.Sum(nil)
+}
+
+// Sign returns t with a signature appended. The empty token is returned
+// unchanged.
+func (s *Signer) Sign(t token.Token) token.Token {
+	if t.IsEmpty() {
+		return t
+	}
+	id := t.String()
+	return token.TokenStr(id + separator + base64.RawURLEncoding.EncodeToString(mac(s.keys[0], id)))
+}
+
+// Verify returns the id signed in t. If t is empty or not signed by one of the
+// keys, ok is false and the empty token is returned.
+func (s *Signer) Verify(t token.Token) (id token.Token, ok bool) {
+	if t.IsEmpty() {
+		return token.EmptyToken, false
+	}
+	i := strings.LastIndex(t.String(), separator)
+	if i < 0 {
+		return token.EmptyToken, false
+	}
+	raw, sig := t.String()[:i], t.String()[i+len(separator):]
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || len(got) != sha256.Size {
+		return token.EmptyToken, false
+	}
+	for _, k := range s.keys {
+		if hmac.Equal(got, mac(k, raw)) {
+			return token.TokenStr(raw), true
+		}
+	}
+	return token.EmptyToken, false
+}
@@ -0,0 +1,46 @@
+package signed
+
+import (
+	"bytes"
+	"github.com/timob/httpsession/token"
+	"testing"
+)
+
+func TestSigner(t *testing.T) {
+	oldKey := bytes.Repeat([]byte("o"), 32)
+	newKey := bytes.Repeat([]byte("n"), 32)
+	old, _ := NewSigner(oldKey)
+	s, err := NewSigner(newKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := s.Sign(token.TokenStr("abc="))
+	if id, ok := s.Verify(signed); !ok || id.String() != "abc=" {
+		t.Fatalf("expected signed token to verify, got %v %v", id, ok)
+	}
+	if id, ok := s.Verify(old.Sign(token.TokenStr("abc="))); !ok || id.String() != "abc=" {
+		t.Fatal("expected token signed with an old key to verify")
+	}
+	if _, ok := old.Verify(signed); ok {
+		t.Fatal("expected token signed with an unknown key to fail")
+	}
+
+	for _, bad := range []token.Token{
+		token.EmptyToken,
+		token.TokenStr("abc="),
+		token.TokenStr("abc=.garbage"),
+		token.TokenStr("abd=" + signed.String()[4:]),
+	} {
+		if id, ok := s.Verify(bad); ok || !id.IsEmpty() {
+			t.Fatalf("expected %q to fail verification", bad)
+		}
+	}
+	if !s.Sign(token.EmptyToken).IsEmpty() {
+		t.Fatal("expected empty token to stay empty")
+	}
+
+	if _, err = NewSigner([]byte("short")); err == nil {
+		t.Fatal("expected short key to be rejected")
+	}
+}
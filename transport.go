@@ -0,0 +1,112 @@
+package httpsession
+
+import (
+	"context"
+	"github.com/timob/httpsession/store"
+	"github.com/timob/httpsession/token"
+	"time"
+)
+
+// TokenTransport carries a token between the client and the server, for
+// example in a cookie or header.
+type TokenTransport interface {
+	// GetToken returns the token sent with the request, or token.EmptyToken.
+	GetToken() token.Token
+	// SetToken sends t to the client, which should keep it for d.
+	SetToken(t token.Token, d time.Duration)
+	// Remove tells the client to forget its token.
+	Remove()
+}
+
+// TransportSession is an AuthSession whose session and auth tokens are read
+// from and sent back through a pair of TokenTransports. Save sends the tokens
+// back, so that the client has the current auth token after it is rotated.
+type TransportSession struct {
+	transport     TokenTransport
+	authTransport TokenTransport
+	sessionToken  token.Token
+	authToken     token.Token
+	*AuthSession
+}
+
+func OpenTransportSession(transport, authTransport TokenTransport, store store.SessionEntryStore) (*TransportSession, error) {
+	return DeaultAuthTimeout.OpenTransportSession(transport, authTransport, store)
+}
+
+func (a AuthTimeout) OpenTransportSession(transport, authTransport TokenTransport, store store.SessionEntryStore) (*TransportSession, error) {
+	return a.OpenTransportSessionWithOptions(context.Background(), transport, authTransport, store, Options{})
+}
+
+func OpenTransportSessionWithOptions(ctx context.Context, transport, authTransport TokenTransport, store store.SessionEntryStore, opts Options) (*TransportSession, error) {
+	return DeaultAuthTimeout.OpenTransportSessionWithOptions(ctx, transport, authTransport, store, opts)
+}
+
+func (a AuthTimeout) OpenTransportSessionWithOptions(ctx context.Context, transport, authTransport TokenTransport, store store.SessionEntryStore, opts Options) (*TransportSession, error) {
+	s, t, at, err := OpenSessionWithAuthOptions(ctx, transport.GetToken(), authTransport.GetToken(), time.Duration(a), store, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &TransportSession{
+		transport:     transport,
+		authTransport: authTransport,
+		sessionToken:  t,
+		authToken:     at,
+		AuthSession:   s,
+	}, nil
+}
+
+// SaveContext is like Save, but uses ctx for store calls.
+func (t *TransportSession) SaveContext(ctx context.Context, timeout time.Duration) error {
+	t.Session.sessionInternal.SetContext(ctx)
+	return t.Save(timeout)
+}
+
+// Save saves the session and sends the tokens to the client. In the grace
+// period after the auth token changed the tokens are not sent, so that a
+// client that missed the new token keeps the old one.
+func (t *TransportSession) Save(timeout time.Duration) error {
+	err := t.Session.Save(timeout)
+	if t.InGracePeriod() == false {
+		t.setTokens(timeout)
+	}
+	return err
+}
+
+// Touch is like Save, but only extends the session expiry if the store
+// supports it. Use it on requests that don't change session values.
+func (t *TransportSession) Touch(timeout time.Duration) error {
+	err := t.Session.Touch(timeout)
+	if t.InGracePeriod() == false {
+		t.setTokens(timeout)
+	}
+	return err
+}
+
+// New deletes the session and starts a new one with a new session token.
+func (t *TransportSession) New() {
+	t.Session.Delete()
+	t.Session.Clear()
+	t.Session.sessionInternal.SetCreatedAt(time.Now())
+	t.sessionToken = t.Session.Recreate()
+}
+
+// RemoveTokens tells the client to forget its tokens.
+func (t *TransportSession) RemoveTokens() {
+	t.transport.Remove()
+	t.authTransport.Remove()
+}
+
+// setTokens sends the tokens to keep until the store entry expires, which
+// the session policy may make sooner than timeout.
+func (t *TransportSession) setTokens(timeout time.Duration) {
+	d := time.Until(t.Session.sessionInternal.Expiry()).Round(time.Second)
+	if d < time.Second {
+		// a zero MaxAge would make a cookie last until the browser closes
+		d = time.Second
+	}
+	if d > timeout {
+		d = timeout
+	}
+	t.transport.SetToken(t.sessionToken, d)
+	t.authTransport.SetToken(t.authToken, d)
+}
@@ -0,0 +1,68 @@
+package httpsession
+
+import "fmt"
+
+// ValueSession is implemented by Session, AuthSession and CookieSession. It
+// is used by the typed accessors Get, Set and Key.
+type ValueSession interface {
+	SetVar(key string, i interface{})
+	Lookup(key string) (v interface{}, ok bool, err error)
+}
+
+// Get returns the value named key as a T. Numbers are converted between
+// numeric types when they fit, and maps and slices decoded by the JSON codecs
+// are converted to T with a JSON round trip. Unlike the IntVar family, errors
+// are returned rather than recorded for GetLastError.
+func Get[T any](s ValueSession, key string) (v T, err error) {
+	i, _, err := s.Lookup(key)
+	if err != nil {
+		return
+	}
+	if t, ok := i.(T); ok {
+		return t, nil
+	}
+	if setNumber(&v, i) {
+		return v, nil
+	}
+	switch i.(type) {
+	case map[string]interface{}, []interface{}:
+		if e, ok := s.(exactSession); ok {
+			if exact, ok := e.exactValue(key); ok {
+				i = exact
+			}
+		}
+		if err = convertValue(i, &v); err == nil {
+			return v, nil
+		}
+		var zero T
+		return zero, fmt.Errorf("%w: %s: %v", ErrTypeMismatch, key, err)
+	}
+	return v, fmt.Errorf("%w: %s is %T, not %T", ErrTypeMismatch, key, i, v)
+}
+
+// exactSession is implemented by the sessions in this package. exactValue
+// returns a map or slice value with the numbers it was decoded with, see
+// GetInto.
+type exactSession interface {
+	exactValue(key string) (interface{}, bool)
+}
+
+// Set sets the value named key.
+func Set[T any](s ValueSession, key string, v T) {
+	s.SetVar(key, v)
+}
+
+// Key names a session value of type T, so that the type is given once where
+// the key is declared:
+//
+//	var cartKey = httpsession.Key[Cart]("cart")
+//	cart, err := cartKey.Get(session)
+type Key[T any] string
+
+func (k Key[T]) Get(s ValueSession) (T, error) {
+	return Get[T](s, string(k))
+}
+
+func (k Key[T]) Set(s ValueSession, v T) {
+	Set(s, string(k), v)
+}
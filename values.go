@@ -0,0 +1,247 @@
+package httpsession
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// valueTypes maps the type names recorded in sessionValues.Types to types,
+// so that values decoded by the JSON codecs are restored to the type they were
+// stored with. It holds the numeric types, except float64 which is what
+// untagged numbers decode to, slices of them, and the types passed to
+// RegisterType.
+var valueTypes = struct {
+	byName map[string]reflect.Type
+	names  map[reflect.Type]string
+	sync.RWMutex
+}{byName: map[string]reflect.Type{}, names: map[reflect.Type]string{}}
+
+func init() {
+	for _, v := range []interface{}{
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0),
+		[]int(nil), []int8(nil), []int16(nil), []int32(nil), []int64(nil),
+		[]uint(nil), []uint16(nil), []uint32(nil), []uint64(nil),
+		[]float32(nil), []float64(nil),
+	} {
+		t := reflect.TypeOf(v)
+		valueTypes.byName[t.String()] = t
+		valueTypes.names[t] = t.String()
+	}
+}
+
+// RegisterType records the type of value, so that session values of that
+// type are read back as that type instead of as a map or slice. Like
+// gob.Register, which it also calls, it is meant to be called from init.
+func RegisterType(value interface{}) {
+	t := reflect.TypeOf(value)
+	// same name as gob.Register, so that both can be called for a type
+	name := t.String()
+	if t.Name() != "" && t.PkgPath() != "" {
+		name = t.PkgPath() + "." + t.Name()
+	}
+	RegisterTypeName(name, value)
+}
+
+// RegisterTypeName is like RegisterType but uses name to identify the type.
+// It panics if name or the type is already registered under another name.
+func RegisterTypeName(name string, value interface{}) {
+	t := reflect.TypeOf(value)
+	valueTypes.Lock()
+	defer valueTypes.Unlock()
+	if n, ok := valueTypes.names[t]; ok && n != name {
+		panic(fmt.Sprintf("httpsession: registering type %s as %q, already registered as %q", t, name, n))
+	}
+	if u, ok := valueTypes.byName[name]; ok && u != t {
+		panic(fmt.Sprintf("httpsession: registering %q for type %s, already used for %s", name, t, u))
+	}
+	valueTypes.byName[name] = t
+	valueTypes.names[t] = name
+	gob.RegisterName(name, value)
+}
+
+// typeTags returns the type names of vals with a registered type.
+func typeTags(vals map[string]interface{}) (tags map[string]string) {
+	valueTypes.RLock()
+	defer valueTypes.RUnlock()
+	for k, v := range vals {
+		if v == nil {
+			continue
+		}
+		name, ok := valueTypes.names[reflect.TypeOf(v)]
+		if !ok {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[k] = name
+	}
+	return
+}
+
+// restoreValue converts a value decoded by the JSON codecs back to the type
+// named by tag. Untagged numbers become float64, as they were before type
+// tags were stored. Maps and slices are copied, so v keeps its json.Number
+// values for an exact conversion by convertValue.
+func restoreValue(v interface{}, tag string) interface{} {
+	if tag != "" && v != nil {
+		valueTypes.RLock()
+		t, ok := valueTypes.byName[tag]
+		valueTypes.RUnlock()
+		if ok && reflect.TypeOf(v) != t {
+			dst := reflect.New(t)
+			if n, isNumber := v.(json.Number); isNumber {
+				ok = setNumber(dst.Interface(), n)
+			} else {
+				ok = convertValue(v, dst.Interface()) == nil
+			}
+			if ok {
+				return dst.Elem().Interface()
+			}
+		}
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = restoreValue(e, "")
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = restoreValue(e, "")
+		}
+		return s
+	}
+	return v
+}
+
+// hasNumbers reports whether v, decoded by the JSON codecs, holds a
+// json.Number.
+func hasNumbers(v interface{}) bool {
+	switch v := v.(type) {
+	case json.Number:
+		return true
+	case map[string]interface{}:
+		for _, e := range v {
+			if hasNumbers(e) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if hasNumbers(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// convertValue stores v in dst, a non-nil pointer, using a JSON round trip if
+// v's type can't be assigned to dst.
+func convertValue(v interface{}, dst interface{}) error {
+	d := reflect.ValueOf(dst)
+	if d.Kind() != reflect.Ptr || d.IsNil() {
+		return fmt.Errorf("destination must be a non-nil pointer, got %T", dst)
+	}
+	if v != nil && reflect.TypeOf(v).AssignableTo(d.Elem().Type()) {
+		d.Elem().Set(reflect.ValueOf(v))
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+// setNumber stores the numeric value i in dst, which points to an integer or
+// float. Floats are truncated when stored in an integer. It returns false if i
+// is not a number or is out of range for dst.
+func setNumber(dst interface{}, i interface{}) bool {
+	d := reflect.ValueOf(dst).Elem()
+	if n, ok := i.(json.Number); ok {
+		if x, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+			i = x
+		} else if x, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+			i = x
+		} else if x, err := n.Float64(); err == nil {
+			i = x
+		} else {
+			return false
+		}
+	}
+
+	v := reflect.ValueOf(i)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x := v.Int()
+		switch d.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if d.OverflowInt(x) {
+				return false
+			}
+			d.SetInt(x)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if x < 0 || d.OverflowUint(uint64(x)) {
+				return false
+			}
+			d.SetUint(uint64(x))
+		case reflect.Float32, reflect.Float64:
+			d.SetFloat(float64(x))
+		default:
+			return false
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x := v.Uint()
+		switch d.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if x > 1<<63-1 || d.OverflowInt(int64(x)) {
+				return false
+			}
+			d.SetInt(int64(x))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if d.OverflowUint(x) {
+				return false
+			}
+			d.SetUint(x)
+		case reflect.Float32, reflect.Float64:
+			d.SetFloat(float64(x))
+		default:
+			return false
+		}
+	case reflect.Float32, reflect.Float64:
+		x := v.Float()
+		switch d.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if x < -1<<63 || x >= 1<<63 || d.OverflowInt(int64(x)) {
+				return false
+			}
+			d.SetInt(int64(x))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if x < 0 || x >= 1<<64 || d.OverflowUint(uint64(x)) {
+				return false
+			}
+			d.SetUint(uint64(x))
+		case reflect.Float32, reflect.Float64:
+			d.SetFloat(x)
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+	return true
+}